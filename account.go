@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+)
+
+//SASL responses are sent in chunks of this length, a shorter one ends it
+const saslChunkLength = 400
+
+//Longest SASL response to accept, base64 encoded
+const saslMaxLength = 8192
+
+//An account users can log in to with SASL, from the account file
+type account struct {
+	name     string
+	password []byte //bcrypt hashed
+	alwaysOn bool   //Keep the client connected when its connections aren't
+}
+
+func loadAccounts(path string) (map[string]*account, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make(map[string]*account)
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexRune(line, '#'); i > -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "always-on") {
+			return nil, fmt.Errorf("invalid account %q", line)
+		}
+
+		accounts[strings.ToLower(fields[0])] = &account{name: fields[0],
+			password: []byte(fields[1]),
+			alwaysOn: len(fields) == 3}
+	}
+	return accounts, nil
+}
+
+//Handle AUTHENTICATE. Only the PLAIN mechanism is supported.
+func (c *Client) authenticate(arg string) {
+	if arg == "*" {
+		c.saslMechanism, c.saslBuffer = "", ""
+		c.reply(errSASLAborted)
+		return
+	}
+
+	if c.saslMechanism == "" {
+		if strings.ToUpper(arg) != "PLAIN" || len(c.server.accountMap) == 0 {
+			c.reply(rplSASLMechs)
+			c.reply(errSASLFail)
+			return
+		}
+		c.saslMechanism = "PLAIN"
+		c.reply(rplAuthenticate, "+")
+		return
+	}
+
+	if arg != "+" {
+		c.saslBuffer += arg
+	}
+	if len(c.saslBuffer) > saslMaxLength {
+		c.saslMechanism, c.saslBuffer = "", ""
+		c.reply(errSASLFail)
+		return
+	}
+	if len(arg) == saslChunkLength {
+		//There's more to come
+		return
+	}
+
+	response := c.saslBuffer
+	c.saslMechanism, c.saslBuffer = "", ""
+
+	account, ok := c.server.checkPlain(response)
+	if !ok {
+		c.reply(errSASLFail)
+		return
+	}
+
+	c.account = account.name
+	c.reply(rplLoggedIn, account.name)
+	c.reply(rplSASLSuccess)
+}
+
+//Check a SASL PLAIN response, returning the account it logs in to
+func (s *Server) checkPlain(response string) (*account, bool) {
+	data, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return nil, false
+	}
+
+	fields := strings.Split(string(data), "\x00")
+	if len(fields) != 3 {
+		return nil, false
+	}
+	authzid, authcid, password := fields[0], fields[1], fields[2]
+
+	//Logging in as someone else isn't allowed
+	if authzid != "" && !strings.EqualFold(authzid, authcid) {
+		return nil, false
+	}
+
+	account, exists := s.accountMap[strings.ToLower(authcid)]
+	if !exists {
+		return nil, false
+	}
+
+	//nil means the passwords matched
+	if err := bcrypt.CompareHashAndPassword(account.password, []byte(password)); err != nil {
+		return nil, false
+	}
+	return account, true
+}
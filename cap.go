@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+)
+
+type capability struct {
+	name string
+
+	//Whether the capability can be enabled by the client, nil if always
+	available func(c *Client) bool
+}
+
+//Every capability the server supports, in the order they're listed
+var capabilities = []capability{
+	{name: "tls", available: func(c *Client) bool {
+		return c.listener != nil && c.listener.starttls && !c.tls && !c.registered
+	}},
+	{name: "message-tags"},
+	{name: "server-time"},
+	{name: "batch"},
+	{name: "labeled-response"},
+	{name: "echo-message"},
+	{name: "multi-prefix"},
+	{name: "userhost-in-names"},
+	{name: "away-notify"},
+	{name: "account-notify"},
+	{name: "extended-join"},
+	{name: "invite-notify"},
+	{name: "setname"},
+	{name: "sasl", available: func(c *Client) bool {
+		return len(c.server.accountMap) > 0
+	}},
+	{name: "draft/chathistory", available: func(c *Client) bool {
+		return c.server.historyLimit > 0
+	}},
+}
+
+func findCapability(name string) (capability, bool) {
+	for _, cap := range capabilities {
+		if cap.name == name {
+			return cap, true
+		}
+	}
+	return capability{}, false
+}
+
+//The capabilities the client could enable, space separated
+func (c *Client) availableCaps() string {
+	names := make([]string, 0, len(capabilities))
+	for _, cap := range capabilities {
+		if cap.available == nil || cap.available(c) {
+			names = append(names, cap.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+//The capabilities the client has enabled, space separated
+func (c *Client) enabledCaps() string {
+	names := make([]string, 0, len(c.caps))
+	for _, cap := range capabilities {
+		if c.caps[cap.name] {
+			names = append(names, cap.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+//Enable and disable capabilities as requested by CAP REQ. Either all of them
+//change or none do.
+func (c *Client) requestCaps(request string) bool {
+	changes := make(map[string]bool)
+	for _, name := range strings.Fields(request) {
+		enable := !strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+
+		cap, exists := findCapability(name)
+		if !exists {
+			return false
+		}
+		if enable && cap.available != nil && !cap.available(c) {
+			return false
+		}
+		changes[name] = enable
+	}
+
+	for name, enable := range changes {
+		if enable {
+			c.caps[name] = true
+		} else {
+			delete(c.caps, name)
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"golang.org/x/text/secure/precis"
+	"strings"
+	"unicode"
+)
+
+//The casemappings that may be chosen, named as they're advertised
+var casemappings = []string{"ascii", "rfc1459", "rfc7613"}
+
+var rfc1459Replacer = strings.NewReplacer("[", "{", "]", "}", `\`, "|", "~", "^")
+
+//Characters from other scripts that look like latin letters, mapped to the
+//letters they could pass for. Names are lower cased before this is used,
+//whatever the casemapping, so only lower case is needed.
+var confusables = map[rune]rune{
+	//Cyrillic
+	'а': 'a', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j',
+	'к': 'k', 'ӏ': 'l', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'ѕ': 's', 'ѵ': 'v',
+	'ԝ': 'w', 'х': 'x', 'у': 'y',
+	//Greek
+	'α': 'a', 'ϲ': 'c', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y',
+	//Latin
+	'ı': 'i', 'ȷ': 'j', 'ɑ': 'a', 'ɡ': 'g',
+}
+
+func asciiLower(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, name)
+}
+
+//Fold a nick or channel name to the key it's kept under, so that names
+//which only differ by case are the same name
+func (s *Server) casefold(name string) string {
+	switch s.casemapping {
+	case "rfc1459":
+		return rfc1459Replacer.Replace(asciiLower(name))
+	case "rfc7613":
+		if key, err := precis.UsernameCaseMapped.CompareKey(name); err == nil {
+			return key
+		}
+		//Names PRECIS won't accept can't be registered, but may still be
+		//looked up
+		return strings.ToLower(name)
+	default:
+		return asciiLower(name)
+	}
+}
+
+//The name with any characters that look like latin letters replaced by
+//them, so names that look the same have the same skeleton
+func (s *Server) skeleton(name string) string {
+	return s.casefold(strings.Map(func(r rune) rune {
+		r = unicode.ToLower(r)
+		if latin, ok := confusables[r]; ok {
+			return latin
+		}
+		return r
+	}, s.casefold(name)))
+}
+
+//Whether a nick looks like someone else's
+func (s *Server) confusable(nick string) bool {
+	owner, exists := s.skeletonMap[s.skeleton(nick)]
+	return exists && owner != s.casefold(nick)
+}
+
+//Add a client to the nick list
+func (s *Server) addClient(c *Client) {
+	s.clientMap[c.key] = c
+	s.skeletonMap[s.skeleton(c.nick)] = c.key
+}
+
+//Take a client off the nick list, if it's the one with its nick
+func (s *Server) removeClient(c *Client) {
+	if s.clientMap[c.key] != c {
+		return
+	}
+	delete(s.clientMap, c.key)
+
+	skeleton := s.skeleton(c.nick)
+	if s.skeletonMap[skeleton] == c.key {
+		delete(s.skeletonMap, skeleton)
+	}
+}
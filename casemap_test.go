@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+//LIST shows channels by the name they were created with, however they're
+//asked for
+func TestListShowsChannelName(t *testing.T) {
+	s := startServer(t, "a.test")
+	amy := dialClient(t, s.plainAddr, "amy")
+	amy.send("JOIN #Foo-Bar")
+	amy.expect(" 366 ")
+
+	for _, command := range []string{"LIST", "LIST #FOO-bar"} {
+		amy.send(command)
+		if line := amy.expect(" 322 "); !strings.Contains(line, " #Foo-Bar ") {
+			t.Errorf("%s: want #Foo-Bar, got %q", command, line)
+		}
+		amy.expect(" 323 ")
+	}
+}
+
+func TestCasefold(t *testing.T) {
+	tests := []struct {
+		casemapping, name, key string
+	}{
+		{"ascii", "Amy", "amy"},
+		{"ascii", "[Amy]~", "[amy]~"},
+		{"ascii", "ÅMY", "Åmy"},
+		{"rfc1459", "Amy", "amy"},
+		{"rfc1459", "[Amy]\\~", "{amy}|^"},
+		{"rfc1459", "{amy}|^", "{amy}|^"},
+		{"rfc7613", "Amy", "amy"},
+		{"rfc7613", "ÅMY", "åmy"},
+		{"rfc7613", "[Amy]", "[amy]"},
+		{"rfc7613", "Amy Pond", "amy pond"},
+	}
+
+	for _, test := range tests {
+		s := testMatchServer()
+		s.casemapping = test.casemapping
+		if key := s.casefold(test.name); key != test.key {
+			t.Errorf("%s %q: got %q, want %q", test.casemapping, test.name, key, test.key)
+		}
+	}
+}
+
+//Nicks that only look like someone else's are caught, whatever case the
+//look-alike letters are in
+func TestConfusable(t *testing.T) {
+	for _, casemapping := range casemappings {
+		s := testMatchServer()
+		s.casemapping = casemapping
+		s.unicodeNames = true
+		testMember(s, "amy", "#test", rankNone)
+		testMember(s, "[rory]", "#test", rankNone)
+
+		tests := []struct {
+			nick      string
+			confusing bool
+		}{
+			{"amy", false},
+			{"AMY", false},
+			{"аmy", true},  //Cyrillic a
+			{"АMY", true},  //Cyrillic A
+			{"αmy", true},  //Greek alpha
+			{"ɑму", false}, //Cyrillic em doesn't look like m
+			{"ɑmy", true},  //Latin alpha
+			{"[rоrу]", true},
+			{"rory", false},
+			{"bob", false},
+		}
+
+		for _, test := range tests {
+			if s.confusable(test.nick) != test.confusing {
+				t.Errorf("%s %q: confusable should be %t", casemapping, test.nick, test.confusing)
+			}
+		}
+	}
+}
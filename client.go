@@ -2,21 +2,30 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
-	"io"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+//Longest partial line to hold on to while waiting for the rest of it
+const maxLineLength = 8192
+
 func (c *Client) setNick(nick string) {
 	//Set up new nick
 	oldNick := c.nick
 	oldKey := c.key
+	c.server.removeClient(c)
 	c.nick = nick
-	c.key = strings.ToLower(c.nick)
+	c.key = c.server.casefold(c.nick)
+	for _, conn := range c.attached {
+		conn.nick, conn.key = c.nick, c.key
+	}
 
-	delete(c.server.clientMap, oldKey)
-	c.server.clientMap[c.key] = c
+	c.server.addClient(c)
 
 	//Update the relevant channels and notify everyone who can see us about our
 	//nick change
@@ -40,23 +49,27 @@ func (c *Client) setNick(nick string) {
 		channel.modeMap[c.key] = channel.modeMap[oldKey]
 		delete(channel.modeMap, oldKey)
 	}
+
+	if c.registered {
+		c.server.propagate(c.route(), ":%s NICK %s %d", oldNick, c.nick, c.nickTS)
+		c.server.monitorOffline(oldNick)
+		c.server.monitorOnline(c)
+	}
 }
 
 func (c *Client) joinChannel(channelName string) {
 	newChannel := false
 
-	channelKey := strings.ToLower(channelName)
+	channelKey := c.server.casefold(channelName)
 	channel, exists := c.server.channelMap[channelKey]
 	if exists == false {
-		mode := ChannelMode{secret: true,
-			topicLocked: true,
-			noExternal:  true}
-		channel = &Channel{name: channelName,
-			topic:     "",
-			clientMap: make(map[string]*Client),
-			modeMap:   make(map[string]*ClientMode),
-			mode:      mode}
-		c.server.channelMap[channelKey] = channel
+		var mode ChannelMode
+		if !strings.HasPrefix(channelName, "+") {
+			for _, char := range "snt" {
+				mode.setFlag(char, true)
+			}
+		}
+		channel = c.server.newChannel(channelName, mode)
 		newChannel = true
 	}
 
@@ -66,52 +79,140 @@ func (c *Client) joinChannel(channelName string) {
 	}
 
 	mode := new(ClientMode)
-	if newChannel {
+	if newChannel && c.origin == nil && !channel.modeless() {
 		//If they created the channel, make them op
-		mode.operator = true
+		mode.set(rankOperator, true)
 	}
 
 	channel.clientMap[c.key] = c
 	channel.modeMap[c.key] = mode
 	c.channelMap[channelKey] = channel
+	delete(c.invited, channelKey)
 
 	for _, client := range channel.clientMap {
-		client.reply(rplJoin, c.nick, channel.name)
+		c.sendJoin(client, channel)
 	}
 
-	if channel.topic != "" {
-		c.reply(rplTopic, channel.name, channel.topic)
+	if newChannel {
+		c.server.propagateChannel(channel, c.route(), ":%s SJOIN %s %d %s :%s%s", c.serverName(), channel.name, channel.created, channel.mode.withParams(true), mode.Prefixes(), c.nick)
 	} else {
-		c.reply(rplNoTopic, channel.name)
+		c.server.propagateChannel(channel, c.route(), ":%s JOIN %s", c.nick, channel.name)
 	}
 
+	c.sendTopic(channel)
+	c.sendNames(channel)
+
+	if channel.mode.hasFlag('H') && !c.hasCap("draft/chathistory") {
+		c.replayHistory(channel)
+	}
+}
+
+//Tell a member of a channel that the client joined it
+func (c *Client) sendJoin(member *Client, channel *Channel) {
+	member.reply(rplJoin, c.nick, channel.name, c.accountName(), c.realname)
+	if c.away != "" && member != c {
+		member.reply(rplAwayNotify, c.nick, c.away)
+	}
+}
+
+//Send a reply to everyone who shares a channel with the client, once each
+func (c *Client) notifyPeers(code replyCode, args ...string) {
+	visited := map[*Client]struct{}{c: {}}
+	for _, channel := range c.channelMap {
+		for _, client := range channel.clientMap {
+			if _, skip := visited[client]; skip {
+				continue
+			}
+			client.reply(code, args...)
+			visited[client] = struct{}{}
+		}
+	}
+}
+
+//The client's account, or * if it isn't logged in
+func (c *Client) accountName() string {
+	if c.account == "" {
+		return "*"
+	}
+	return c.account
+}
+
+//Send the client the names of everyone in a channel, highest ranked first
+func (c *Client) sendNames(channel *Channel) {
 	//The capacity sets the max number of nicks to send per message
 	nicks := make([]string, 0, 128)
 
+	members := make([]*Client, 0, len(channel.clientMap))
 	for _, client := range channel.clientMap {
+		members = append(members, client)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		ri, rj := channel.modeMap[members[i].key].highest(), channel.modeMap[members[j].key].highest()
+		if ri != rj {
+			return ri > rj
+		}
+		return members[i].key < members[j].key
+	})
+
+	for _, client := range members {
 		prefix := ""
 
 		if mode, exists := channel.modeMap[client.key]; exists {
-			prefix = mode.Prefix()
+			prefix = c.modePrefix(mode)
 		}
 
 		if len(nicks) >= cap(nicks) {
-			c.reply(rplNames, channelName, strings.Join(nicks, " "))
+			c.reply(rplNames, channel.name, strings.Join(nicks, " "))
 			nicks = nicks[:0]
 		}
 
-		nicks = append(nicks, fmt.Sprintf("%s%s", prefix, client.nick))
+		name := client.nick
+		if c.hasCap("userhost-in-names") {
+			name = client.userhost()
+		}
+		nicks = append(nicks, fmt.Sprintf("%s%s", prefix, name))
 	}
 
 	if len(nicks) > 0 {
-		c.reply(rplNames, channelName, strings.Join(nicks, " "))
+		c.reply(rplNames, channel.name, strings.Join(nicks, " "))
+	}
+
+	c.reply(rplEndOfNames, channel.name)
+}
+
+//Send a WHO reply about target, as a member of channel if it's given
+func (c *Client) sendWho(channel string, target *Client, mode *ClientMode) {
+	flags := "H"
+	if target.operator {
+		flags += "*"
+	}
+	if mode != nil {
+		flags += c.modePrefix(mode)
+	}
+
+	hops := 0
+	if target.origin != nil {
+		hops = target.origin.hops
 	}
+	c.reply(rplWhoReply, channel, target.username, target.serverName(), target.nick, flags, fmt.Sprintf("%d %s", hops, target.realname))
+}
+
+//The prefix to show for a member of a channel, or all of them with
+//multi-prefix
+func (c *Client) modePrefix(mode *ClientMode) string {
+	if c.hasCap("multi-prefix") {
+		return mode.Prefixes()
+	}
+	return mode.Prefix()
+}
 
-	c.reply(rplEndOfNames, channelName)
+//The client's nick!user@host. Hosts are never shown, so that's always *.
+func (c *Client) userhost() string {
+	return fmt.Sprintf("%s!%s@*", c.nick, c.username)
 }
 
 func (c *Client) partChannel(channelName, reason string) {
-	channelKey := strings.ToLower(channelName)
+	channelKey := c.server.casefold(channelName)
 	channel, exists := c.server.channelMap[channelKey]
 	if exists == false {
 		return
@@ -132,111 +233,561 @@ func (c *Client) partChannel(channelName, reason string) {
 	delete(channel.clientMap, c.key)
 
 	if len(channel.clientMap) == 0 {
-		delete(c.server.channelMap, channelKey)
+		c.server.removeChannel(channel)
 	}
+
+	c.server.propagateChannel(channel, c.route(), ":%s PART %s %s", c.nick, channel.name, reason)
+}
+
+//Remove the client from its channels and the nick list, telling everyone who
+//shares a channel with it. Propagating the quit is up to the caller.
+func (c *Client) quit(reason string) {
+	visited := make(map[*Client]struct{}, 100)
+	visited[c] = struct{}{}
+	for _, channel := range c.channelMap {
+		for _, client := range channel.clientMap {
+			if _, skip := visited[client]; skip {
+				continue
+			}
+			client.reply(rplQuit, c.nick, reason)
+			visited[client] = struct{}{}
+		}
+
+		delete(channel.clientMap, c.key)
+		delete(channel.modeMap, c.key)
+		if len(channel.clientMap) == 0 {
+			c.server.removeChannel(channel)
+		}
+	}
+	c.channelMap = make(map[string]*Channel)
+
+	if c.server.clientMap[c.key] == c {
+		c.server.removeClient(c)
+		if c.registered {
+			c.server.monitorOffline(c.nick)
+		}
+	}
+	c.monitorClear()
+	for account, session := range c.server.sessionMap {
+		if session == c {
+			delete(c.server.sessionMap, account)
+		}
+	}
+}
+
+//Deliver a message to a channel or a user, wherever they are on the network.
+//tags holds the msgid and time given to the message by the server it was
+//sent to, or nil if that's us.
+func (c *Client) privmsg(command, target, message string, tags map[string]string) {
+	if tags == nil {
+		tags = newMessageTags()
+	}
+
+	code := rplMsg
+	if command == "NOTICE" {
+		code = rplNoticeMsg
+	}
+
+	if channel, exists := c.server.channelMap[c.server.casefold(target)]; exists {
+		for _, client := range channel.clientMap {
+			if client != c {
+				client.replyTags(tags, code, c.nick, target, message)
+			}
+		}
+		c.echo(tags, code, target, message)
+
+		//Only PRIVMSGs are kept in history
+		if code == rplMsg {
+			sent, err := time.Parse(timeFormat, tags["time"])
+			if err != nil {
+				sent = time.Now()
+			}
+			c.server.addHistory(channel, historyMessage{ID: tags["msgid"],
+				Time:   sent,
+				Source: c.nick,
+				Target: channel.name,
+				Text:   message})
+		}
+
+		c.server.propagateChannel(channel, c.route(), "%s:%s %s %s :%s", formatTags(tags), c.nick, command, channel.name, message)
+	} else if client, exists := c.server.clientMap[c.server.casefold(target)]; exists {
+		client.replyTags(tags, code, c.nick, client.nick, message)
+		c.echo(tags, code, client.nick, message)
+		if route := client.route(); route != nil && route != c.route() {
+			route.send(fmt.Sprintf("%s:%s %s %s :%s", formatTags(tags), c.nick, command, client.nick, message))
+		}
+	}
+}
+
+//Mark the client as away, or back if message is empty
+func (c *Client) setAway(message string) {
+	c.away = message
+	if message == "" {
+		c.reply(rplUnAway)
+		c.server.propagate(c.route(), ":%s AWAY", c.nick)
+	} else {
+		c.reply(rplNowAway)
+		c.server.propagate(c.route(), ":%s AWAY :%s", c.nick, message)
+	}
+	c.notifyPeers(rplAwayNotify, c.nick, message)
+}
+
+func (c *Client) setName(realname string) {
+	c.realname = realname
+	c.reply(rplSetName, c.nick, realname)
+	c.notifyPeers(rplSetName, c.nick, realname)
+	c.server.propagate(c.route(), ":%s SETNAME :%s", c.nick, realname)
+}
+
+//Invite target to a channel, letting the channel's members know
+func (c *Client) invite(target *Client, channel *Channel) {
+	if target.invited == nil {
+		target.invited = make(map[string]struct{})
+	}
+	target.invited[c.server.casefold(channel.name)] = struct{}{}
+
+	target.reply(rplInvite, c.nick, target.nick, channel.name)
+	for _, client := range channel.clientMap {
+		if client != c {
+			client.reply(rplInviteNotify, c.nick, target.nick, channel.name)
+		}
+	}
+
+	c.server.propagateChannel(channel, c.route(), ":%s INVITE %s %s", c.nick, target.nick, channel.name)
+}
+
+//Send a WHOIS reply about target
+func (c *Client) sendWhois(target *Client) {
+	c.reply(rplWhoisUser, target.nick, target.username, target.realname)
+
+	var channels []string
+	for _, channel := range target.channelMap {
+		if _, shared := channel.clientMap[c.key]; shared || !channel.mode.hasFlag('s') {
+			channels = append(channels, c.modePrefix(channel.modeMap[target.key])+channel.name)
+		}
+	}
+	if len(channels) > 0 {
+		c.reply(rplWhoisChannels, target.nick, strings.Join(channels, " "))
+	}
+
+	c.reply(rplWhoisServer, target.nick, target.serverName())
+	if target.operator {
+		c.reply(rplWhoisOperator, target.nick)
+	}
+	if target.account != "" {
+		c.reply(rplWhoisAccount, target.nick, target.account)
+	}
+	if target.away != "" {
+		c.reply(rplAway, target.nick, target.away)
+	}
+	c.reply(rplEndOfWhois, target.nick)
+}
+
+//Send the client a channel's topic, with who set it and when
+func (c *Client) sendTopic(channel *Channel) {
+	if channel.topic == "" {
+		c.reply(rplNoTopic, channel.name)
+		return
+	}
+
+	c.reply(rplTopic, channel.name, channel.topic)
+	c.reply(rplTopicWhoTime, channel.name, channel.topicSetter, strconv.FormatInt(channel.topicTime, 10))
+}
+
+func (c *Client) setTopic(channel *Channel, topic string) {
+	channel.topic = topic
+	channel.topicSetter = c.nick
+	channel.topicTime = time.Now().Unix()
+	for _, client := range channel.clientMap {
+		client.reply(rplTopicChange, c.nick, channel.name, topic)
+	}
+
+	c.server.propagateChannel(channel, c.route(), ":%s TOPIC %s :%s", c.nick, channel.name, topic)
+}
+
+func (c *Client) kick(channel *Channel, target *Client, reason string) {
+	for _, client := range channel.clientMap {
+		client.reply(rplKick, c.nick, channel.name, target.nick, reason)
+	}
+
+	delete(channel.clientMap, target.key)
+	delete(channel.modeMap, target.key)
+	delete(target.channelMap, c.server.casefold(channel.name))
+	if len(channel.clientMap) == 0 {
+		c.server.removeChannel(channel)
+	}
+
+	c.server.propagateChannel(channel, c.route(), ":%s KICK %s %s %s", c.nick, channel.name, target.nick, reason)
+}
+
+//Complete registration once we have everything we need from the client
+func (c *Client) register() {
+	if c.registered || c.capNegotiating || c.nick == "" || c.username == "" {
+		return
+	}
+
+	if c.account != "" {
+		if session, exists := c.server.sessionMap[strings.ToLower(c.account)]; exists {
+			c.attach(session)
+			return
+		}
+		if account, exists := c.server.accountMap[strings.ToLower(c.account)]; exists && account.alwaysOn {
+			c.attach(c.server.newSession(c))
+			return
+		}
+	}
+
+	if c.server.clientMap[c.key] != c {
+		//They asked for the nick of an always-on client they didn't log in to
+		nick := c.nick
+		c.nick, c.key = "", ""
+		c.reply(errNickInUse, nick)
+		return
+	}
+
+	c.registered = true
+	c.reply(rplWelcome)
+	c.sendISupport()
+
+	c.server.propagateLine(nil, c.uid())
+	c.server.monitorOnline(c)
 }
 
 func (c *Client) disconnect() {
+	if c.persistent {
+		//Only when it's killed, which takes its connections with it
+		for _, conn := range c.attached {
+			conn.disconnect()
+		}
+		return
+	}
+
 	c.connected = false
 	c.signalChan <- signalStop
 }
 
-//Send a reply to a user with the code specified
+//Stop serving the client so its connection can be handed to a new process
+func (c *Client) detach(deadline time.Time) {
+	c.connected = false
+	c.detached = true
+	c.flushDeadline = deadline
+	c.signalChan <- signalDetach
+}
+
+//Disconnect the client once its queued output has been written, giving up at
+//the deadline specified
+func (c *Client) flush(deadline time.Time) {
+	c.connected = false
+	c.flushDeadline = deadline
+	c.signalChan <- signalFlush
+}
+
+//Send a line to a linked server
+func (c *Client) send(line string) {
+	if c.connected == false {
+		return
+	}
+	c.outputChan <- line
+}
+
+//Send a reply to a user with the code specified. Clients on other servers are
+//never connected, so replies to them go nowhere.
 func (c *Client) reply(code replyCode, args ...string) {
+	c.replyTags(nil, code, args...)
+}
+
+//Send a reply with message tags, which are only sent to clients that have
+//enabled the capabilities they need
+func (c *Client) replyTags(tags map[string]string, code replyCode, args ...string) {
+	if c.persistent {
+		c.replySession(tags, code, args...)
+		return
+	}
 	if c.connected == false {
 		return
 	}
 
+	line := ""
 	switch code {
 	case rplWelcome:
-		c.outputChan <- fmt.Sprintf(":%s 001 %s :Welcome to %s", c.server.name, c.nick, c.server.name)
+		line = fmt.Sprintf(":%s 001 %s :Welcome to %s", c.server.name, c.nick, c.server.name)
+	case rplISupport:
+		line = fmt.Sprintf(":%s 005 %s %s :are supported by this server", c.server.name, c.nick, strings.Join(args, " "))
 	case rplJoin:
-		c.outputChan <- fmt.Sprintf(":%s JOIN %s", args[0], args[1])
+		if c.caps["extended-join"] && len(args) > 3 {
+			line = fmt.Sprintf(":%s JOIN %s %s :%s", args[0], args[1], args[2], args[3])
+		} else {
+			line = fmt.Sprintf(":%s JOIN %s", args[0], args[1])
+		}
 	case rplPart:
-		c.outputChan <- fmt.Sprintf(":%s PART %s %s", args[0], args[1], args[2])
+		line = fmt.Sprintf(":%s PART %s %s", args[0], args[1], args[2])
 	case rplTopic:
-		c.outputChan <- fmt.Sprintf(":%s 332 %s %s :%s", c.server.name, c.nick, args[0], args[1])
+		line = fmt.Sprintf(":%s 332 %s %s :%s", c.server.name, c.nick, args[0], args[1])
 	case rplNoTopic:
-		c.outputChan <- fmt.Sprintf(":%s 331 %s %s :No topic is set", c.server.name, c.nick, args[0])
+		line = fmt.Sprintf(":%s 331 %s %s :No topic is set", c.server.name, c.nick, args[0])
+	case rplTopicWhoTime:
+		line = fmt.Sprintf(":%s 333 %s %s %s %s", c.server.name, c.nick, args[0], args[1], args[2])
+	case rplTopicChange:
+		line = fmt.Sprintf(":%s TOPIC %s :%s", args[0], args[1], args[2])
 	case rplNames:
-		c.outputChan <- fmt.Sprintf(":%s 353 %s = %s :%s", c.server.name, c.nick, args[0], args[1])
+		line = fmt.Sprintf(":%s 353 %s = %s :%s", c.server.name, c.nick, args[0], args[1])
 	case rplEndOfNames:
-		c.outputChan <- fmt.Sprintf(":%s 366 %s %s :End of NAMES list", c.server.name, c.nick, args[0])
+		line = fmt.Sprintf(":%s 366 %s %s :End of NAMES list", c.server.name, c.nick, args[0])
+	case rplWhoReply:
+		line = fmt.Sprintf(":%s 352 %s %s %s * %s %s %s :%s", c.server.name, c.nick, args[0], args[1], args[2], args[3], args[4], args[5])
+	case rplEndOfWho:
+		line = fmt.Sprintf(":%s 315 %s %s :End of WHO list", c.server.name, c.nick, args[0])
+	case rplWhoisUser:
+		line = fmt.Sprintf(":%s 311 %s %s %s * * :%s", c.server.name, c.nick, args[0], args[1], args[2])
+	case rplWhoisServer:
+		line = fmt.Sprintf(":%s 312 %s %s %s :Rosella", c.server.name, c.nick, args[0], args[1])
+	case rplWhoisOperator:
+		line = fmt.Sprintf(":%s 313 %s %s :is an IRC operator", c.server.name, c.nick, args[0])
+	case rplWhoisAccount:
+		line = fmt.Sprintf(":%s 330 %s %s %s :is logged in as", c.server.name, c.nick, args[0], args[1])
+	case rplWhoisChannels:
+		line = fmt.Sprintf(":%s 319 %s %s :%s", c.server.name, c.nick, args[0], args[1])
+	case rplEndOfWhois:
+		line = fmt.Sprintf(":%s 318 %s %s :End of WHOIS list", c.server.name, c.nick, args[0])
+	case rplAway:
+		line = fmt.Sprintf(":%s 301 %s %s :%s", c.server.name, c.nick, args[0], args[1])
+	case rplUnAway:
+		line = fmt.Sprintf(":%s 305 %s :You are no longer marked as being away", c.server.name, c.nick)
+	case rplNowAway:
+		line = fmt.Sprintf(":%s 306 %s :You have been marked as being away", c.server.name, c.nick)
+	case rplAwayNotify:
+		if c.caps["away-notify"] && args[1] == "" {
+			line = fmt.Sprintf(":%s AWAY", args[0])
+		} else if c.caps["away-notify"] {
+			line = fmt.Sprintf(":%s AWAY :%s", args[0], args[1])
+		}
+	case rplAccountNotify:
+		if c.caps["account-notify"] {
+			line = fmt.Sprintf(":%s ACCOUNT %s", args[0], args[1])
+		}
+	case rplSetName:
+		if c.caps["setname"] {
+			line = fmt.Sprintf(":%s SETNAME :%s", args[0], args[1])
+		}
+	case rplInvite:
+		line = fmt.Sprintf(":%s INVITE %s %s", args[0], args[1], args[2])
+	case rplInviteNotify:
+		if c.caps["invite-notify"] {
+			line = fmt.Sprintf(":%s INVITE %s %s", args[0], args[1], args[2])
+		}
+	case rplInviting:
+		line = fmt.Sprintf(":%s 341 %s %s %s", c.server.name, c.nick, args[0], args[1])
+	case rplMonOnline:
+		line = fmt.Sprintf(":%s 730 %s :%s", c.server.name, c.nick, args[0])
+	case rplMonOffline:
+		line = fmt.Sprintf(":%s 731 %s :%s", c.server.name, c.nick, args[0])
+	case rplMonList:
+		line = fmt.Sprintf(":%s 732 %s :%s", c.server.name, c.nick, args[0])
+	case rplEndOfMonList:
+		line = fmt.Sprintf(":%s 733 %s :End of MONITOR list", c.server.name, c.nick)
 	case rplNickChange:
-		c.outputChan <- fmt.Sprintf(":%s NICK %s", args[0], args[1])
+		line = fmt.Sprintf(":%s NICK %s", args[0], args[1])
 	case rplKill:
-		c.outputChan <- fmt.Sprintf(":%s KILL %s A %s", args[0], c.nick, args[1])
+		line = fmt.Sprintf(":%s KILL %s A %s", args[0], c.nick, args[1])
 	case rplMsg:
-		c.outputChan <- fmt.Sprintf(":%s PRIVMSG %s %s", args[0], args[1], args[2])
+		line = fmt.Sprintf(":%s PRIVMSG %s :%s", args[0], args[1], args[2])
+	case rplNoticeMsg:
+		line = fmt.Sprintf(":%s NOTICE %s :%s", args[0], args[1], args[2])
 	case rplList:
-		c.outputChan <- fmt.Sprintf(":%s 322 %s %s", c.server.name, c.nick, args[0])
+		line = fmt.Sprintf(":%s 322 %s %s", c.server.name, c.nick, args[0])
 	case rplListEnd:
-		c.outputChan <- fmt.Sprintf(":%s 323 %s", c.server.name, c.nick)
+		line = fmt.Sprintf(":%s 323 %s", c.server.name, c.nick)
 	case rplOper:
-		c.outputChan <- fmt.Sprintf(":%s 381 %s :You are now an operator", c.server.name, c.nick)
+		line = fmt.Sprintf(":%s 381 %s :You are now an operator", c.server.name, c.nick)
 	case rplChannelModeIs:
-		c.outputChan <- fmt.Sprintf(":%s 324 %s %s %s %s", c.server.name, c.nick, args[0], args[1], args[2])
+		line = fmt.Sprintf(":%s 324 %s %s %s", c.server.name, c.nick, args[0], args[1])
+	case rplCreationTime:
+		line = fmt.Sprintf(":%s 329 %s %s %s", c.server.name, c.nick, args[0], args[1])
+	case rplModeChange:
+		line = fmt.Sprintf(":%s MODE %s %s", args[0], args[1], args[2])
+	case rplBanList:
+		line = fmt.Sprintf(":%s 367 %s %s %s %s %s", c.server.name, c.nick, args[0], args[1], args[2], args[3])
+	case rplEndOfBanList:
+		line = fmt.Sprintf(":%s 368 %s %s :End of channel ban list", c.server.name, c.nick, args[0])
+	case rplExceptList:
+		line = fmt.Sprintf(":%s 348 %s %s %s %s %s", c.server.name, c.nick, args[0], args[1], args[2], args[3])
+	case rplEndOfExceptList:
+		line = fmt.Sprintf(":%s 349 %s %s :End of channel exception list", c.server.name, c.nick, args[0])
+	case rplInviteList:
+		line = fmt.Sprintf(":%s 346 %s %s %s %s %s", c.server.name, c.nick, args[0], args[1], args[2], args[3])
+	case rplEndOfInviteList:
+		line = fmt.Sprintf(":%s 347 %s %s :End of channel invite list", c.server.name, c.nick, args[0])
 	case rplKick:
-		c.outputChan <- fmt.Sprintf(":%s KICK %s %s %s", args[0], args[1], args[2], args[3])
+		line = fmt.Sprintf(":%s KICK %s %s %s", args[0], args[1], args[2], args[3])
 	case rplInfo:
-		c.outputChan <- fmt.Sprintf(":%s 371 %s :%s", c.server.name, c.nick, args[0])
+		line = fmt.Sprintf(":%s 371 %s :%s", c.server.name, c.nick, args[0])
 	case rplVersion:
-		c.outputChan <- fmt.Sprintf(":%s 351 %s %s", c.server.name, c.nick, args[0])
+		line = fmt.Sprintf(":%s 351 %s %s", c.server.name, c.nick, args[0])
 	case rplMOTDStart:
-		c.outputChan <- fmt.Sprintf(":%s 375 %s :- Message of the day - ", c.server.name, c.nick)
+		line = fmt.Sprintf(":%s 375 %s :- Message of the day - ", c.server.name, c.nick)
 	case rplMOTD:
-		c.outputChan <- fmt.Sprintf(":%s 372 %s :- %s", c.server.name, c.nick, args[0])
+		line = fmt.Sprintf(":%s 372 %s :- %s", c.server.name, c.nick, args[0])
 	case rplEndOfMOTD:
-		c.outputChan <- fmt.Sprintf(":%s 376 %s :End of MOTD Command", c.server.name, c.nick)
+		line = fmt.Sprintf(":%s 376 %s :End of MOTD Command", c.server.name, c.nick)
 	case rplPong:
-		c.outputChan <- fmt.Sprintf(":%s PONG %s %s", c.server.name, c.nick, c.server.name)
+		line = fmt.Sprintf(":%s PONG %s %s", c.server.name, c.nick, c.server.name)
+	case rplNotice:
+		line = fmt.Sprintf(":%s NOTICE %s :%s", c.server.name, c.target(), args[0])
+	case rplCap:
+		line = fmt.Sprintf(":%s CAP %s %s :%s", c.server.name, c.target(), args[0], args[1])
+	case rplStartTLS:
+		line = fmt.Sprintf(":%s 670 %s :STARTTLS successful, proceed with TLS handshake", c.server.name, c.target())
+	case rplQuit:
+		line = fmt.Sprintf(":%s QUIT :%s", args[0], args[1])
+	case rplLinks:
+		line = fmt.Sprintf(":%s 364 %s %s %s :%s Rosella", c.server.name, c.nick, args[0], args[1], args[2])
+	case rplEndOfLinks:
+		line = fmt.Sprintf(":%s 365 %s * :End of LINKS list", c.server.name, c.nick)
+	case rplLoggedIn:
+		line = fmt.Sprintf(":%s 900 %s %s!%s@* %s :You are now logged in as %s", c.server.name, c.target(), c.target(), c.username, args[0], args[0])
+	case rplLoggedOut:
+		line = fmt.Sprintf(":%s 901 %s %s!%s@* :You are now logged out", c.server.name, c.nick, c.nick, c.username)
+	case rplBatchStart:
+		line = fmt.Sprintf(":%s BATCH +%s %s", c.server.name, args[0], args[1])
+	case rplBatchEnd:
+		line = fmt.Sprintf(":%s BATCH -%s", c.server.name, args[0])
+	case rplHistoryTarget:
+		line = fmt.Sprintf(":%s CHATHISTORY TARGETS %s %s", c.server.name, args[0], args[1])
+	case rplFail:
+		//FAIL command code [context...] :description
+		line = fmt.Sprintf(":%s FAIL %s :%s", c.server.name, strings.Join(args[:len(args)-1], " "), args[len(args)-1])
+	case rplAck:
+		line = fmt.Sprintf(":%s ACK", c.server.name)
+	case rplAuthenticate:
+		line = fmt.Sprintf("AUTHENTICATE %s", args[0])
+	case rplSASLSuccess:
+		line = fmt.Sprintf(":%s 903 %s :SASL authentication successful", c.server.name, c.target())
+	case rplSASLMechs:
+		line = fmt.Sprintf(":%s 908 %s PLAIN :are available SASL mechanisms", c.server.name, c.target())
+	case rplClosingLink:
+		line = fmt.Sprintf("ERROR :Closing Link: %s (%s)", c.nick, args[0])
 	case errMoreArgs:
-		c.outputChan <- fmt.Sprintf(":%s 461 %s :Not enough params", c.server.name, c.nick)
+		line = fmt.Sprintf(":%s 461 %s :Not enough params", c.server.name, c.nick)
 	case errNoNick:
-		c.outputChan <- fmt.Sprintf(":%s 431 %s :No nickname given", c.server.name, c.nick)
+		line = fmt.Sprintf(":%s 431 %s :No nickname given", c.server.name, c.nick)
 	case errInvalidNick:
-		c.outputChan <- fmt.Sprintf(":%s 432 %s %s :Erronenous nickname", c.server.name, c.nick, args[0])
+		line = fmt.Sprintf(":%s 432 %s %s :Erronenous nickname: %s", c.server.name, c.nick, args[0], args[1])
 	case errNickInUse:
-		c.outputChan <- fmt.Sprintf(":%s 433 %s %s :Nick already in use", c.server.name, c.nick, args[0])
+		line = fmt.Sprintf(":%s 433 %s %s :Nick already in use", c.server.name, c.nick, args[0])
 	case errAlreadyReg:
-		c.outputChan <- fmt.Sprintf(":%s 462 :You need a valid nick first", c.server.name)
+		line = fmt.Sprintf(":%s 462 %s :You may not reregister", c.server.name, c.nick)
+	case errNoSuchServer:
+		line = fmt.Sprintf(":%s 402 %s %s :No such server", c.server.name, c.nick, args[0])
+	case errNoSuchChannel:
+		line = fmt.Sprintf(":%s 403 %s %s :No such channel", c.server.name, c.nick, args[0])
+	case errNoChanModes:
+		line = fmt.Sprintf(":%s 477 %s %s :Channel doesn't support modes", c.server.name, c.nick, args[0])
+	case errBadChanName:
+		line = fmt.Sprintf(":%s 479 %s %s :Illegal channel name: %s", c.server.name, c.nick, args[0], args[1])
+	case errMonListFull:
+		line = fmt.Sprintf(":%s 734 %s %s %s :Monitor list is full", c.server.name, c.nick, args[0], args[1])
+	case errNotOnChannel:
+		line = fmt.Sprintf(":%s 442 %s %s :You're not on that channel", c.server.name, c.nick, args[0])
+	case errUserOnChannel:
+		line = fmt.Sprintf(":%s 443 %s %s %s :is already on channel", c.server.name, c.nick, args[0], args[1])
 	case errNoSuchNick:
-		c.outputChan <- fmt.Sprintf(":%s 401 %s %s :No such nick/channel", c.server.name, c.nick, args[0])
+		line = fmt.Sprintf(":%s 401 %s %s :No such nick/channel", c.server.name, c.nick, args[0])
 	case errUnknownCommand:
-		c.outputChan <- fmt.Sprintf(":%s 421 %s %s :Unknown command", c.server.name, c.nick, args[0])
+		line = fmt.Sprintf(":%s 421 %s %s :Unknown command", c.server.name, c.nick, args[0])
 	case errNotReg:
-		c.outputChan <- fmt.Sprintf(":%s 451 :You have not registered", c.server.name)
+		line = fmt.Sprintf(":%s 451 :You have not registered", c.server.name)
 	case errPassword:
-		c.outputChan <- fmt.Sprintf(":%s 464 %s :Error, password incorrect", c.server.name, c.nick)
+		line = fmt.Sprintf(":%s 464 %s :Error, password incorrect", c.server.name, c.nick)
 	case errNoPriv:
-		c.outputChan <- fmt.Sprintf(":%s 481 %s :Permission denied", c.server.name, c.nick)
+		line = fmt.Sprintf(":%s 481 %s :Permission denied", c.server.name, c.nick)
+	case errChanOPrivsNeeded:
+		line = fmt.Sprintf(":%s 482 %s %s :You're not a channel operator", c.server.name, c.nick, args[0])
+	case errUnknownMode:
+		line = fmt.Sprintf(":%s 472 %s %s :is unknown mode char to me for %s", c.server.name, c.nick, args[0], args[1])
+	case errInvalidModeParam:
+		line = fmt.Sprintf(":%s 696 %s %s %s %s :%s", c.server.name, c.nick, args[0], args[1], args[2], args[3])
+	case errChannelIsFull:
+		line = fmt.Sprintf(":%s 471 %s %s :Cannot join channel (+l)", c.server.name, c.nick, args[0])
+	case errInviteOnlyChan:
+		line = fmt.Sprintf(":%s 473 %s %s :Cannot join channel (+i)", c.server.name, c.nick, args[0])
+	case errBannedFromChan:
+		line = fmt.Sprintf(":%s 474 %s %s :Cannot join channel (+b)", c.server.name, c.nick, args[0])
+	case errBadChannelKey:
+		line = fmt.Sprintf(":%s 475 %s %s :Cannot join channel (+k)", c.server.name, c.nick, args[0])
+	case errBanListFull:
+		line = fmt.Sprintf(":%s 478 %s %s %s %s :Channel list is full", c.server.name, c.nick, args[0], args[1], args[2])
+	case errBanOnChan:
+		line = fmt.Sprintf(":%s 435 %s %s %s :Cannot change nickname while banned or quieted on channel", c.server.name, c.nick, args[0], args[1])
+	case errNeedReggedNick:
+		line = fmt.Sprintf(":%s 477 %s %s :Cannot join channel (+r) - you need to be logged in", c.server.name, c.nick, args[0])
+	case errSecureOnlyChan:
+		line = fmt.Sprintf(":%s 489 %s %s :Cannot join channel (+z) - you need to use TLS", c.server.name, c.nick, args[0])
 	case errCannotSend:
-		c.outputChan <- fmt.Sprintf(":%s 404 %s %s :Cannot send to channel", c.server.name, c.nick, args[0])
+		line = fmt.Sprintf(":%s 404 %s %s :Cannot send to channel (+%s)", c.server.name, c.nick, args[0], args[1])
+	case errInvalidCapCmd:
+		line = fmt.Sprintf(":%s 410 %s %s :Invalid CAP command", c.server.name, c.target(), args[0])
+	case errStartTLS:
+		line = fmt.Sprintf(":%s 691 %s :%s", c.server.name, c.target(), args[0])
+	case errTLSRequired:
+		line = fmt.Sprintf(":%s 451 %s :You must use STARTTLS before registering", c.server.name, c.target())
+	case errSASLFail:
+		line = fmt.Sprintf(":%s 904 %s :SASL authentication failed", c.server.name, c.target())
+	case errSASLAborted:
+		line = fmt.Sprintf(":%s 906 %s :SASL authentication aborted", c.server.name, c.target())
+	case errSASLAlready:
+		line = fmt.Sprintf(":%s 907 %s :You have already authenticated using SASL", c.server.name, c.target())
 	}
+
+	c.write(tags, line)
+}
+
+//The nick to address replies to, which may not be set yet
+func (c *Client) target() string {
+	if c.nick == "" {
+		return "*"
+	}
+	return c.nick
 }
 
 func (c *Client) clientThread() {
 	readSignalChan := make(chan signalCode, 3)
 	writeSignalChan := make(chan signalCode, 3)
+	readDoneChan := make(chan struct{})
+	writeDoneChan := make(chan struct{})
 	writeChan := make(chan string, 100)
 
 	c.server.eventChan <- Event{client: c, event: connected}
 
-	go c.readThread(readSignalChan)
-	go c.writeThread(writeSignalChan, writeChan)
+	go c.readThread(readSignalChan, readDoneChan)
+	go c.writeThread(writeSignalChan, writeChan, writeDoneChan)
 
 	defer func() {
-		//Part from all channels
-		for channelName := range c.channelMap {
-			c.partChannel(channelName, "Disconnecting")
+		if c.detached {
+			//Keep a copy of the connection open for the new process
+			if f, ok := c.conn().(filer); ok {
+				c.handoffFile, _ = f.File()
+			}
 		}
+		c.conn().Close()
 
-		delete(c.server.clientMap, c.key)
-
-		c.connection.Close()
+		//Let the server clean up after us
+		c.server.eventChan <- Event{client: c, event: disconnected}
+		c.server.clientGroup.Done()
 	}()
 
+	//Output for a link that its write thread hasn't taken yet. Links can fall
+	//behind during a burst, so rather than being dropped straight away or
+	//holding up the event loop, they queue up to linkSendQ lines.
+	var queue []string
+
 	for {
+		//Only offer the write thread a queued line when there is one
+		var queueChan chan string
+		var next string
+		if len(queue) > 0 {
+			queueChan, next = writeChan, queue[0]
+		}
+
 		select {
 		case signal := <-c.signalChan:
 			if signal == signalStop {
@@ -244,19 +795,72 @@ func (c *Client) clientThread() {
 				writeSignalChan <- signalStop
 				return
 			}
+			if signal == signalFlush {
+				readSignalChan <- signalStop
+				c.sendQueued(queue, writeChan, writeDoneChan)
+				writeSignalChan <- signalFlush
+				<-writeDoneChan
+				return
+			}
+			if signal == signalDetach {
+				//Make sure nothing more is read from the connection, so the
+				//new process picks up exactly where we left off
+				readSignalChan <- signalStop
+				c.conn().SetReadDeadline(time.Now())
+				<-readDoneChan
+				writeSignalChan <- signalFlush
+				<-writeDoneChan
+				return
+			}
+		case queueChan <- next:
+			queue = queue[1:]
 		case line := <-c.outputChan:
-			select {
-			case writeChan <- line:
-				continue
-			default:
+			if len(queue) == 0 {
+				select {
+				case writeChan <- line:
+					continue
+				default:
+				}
+			}
+
+			if !c.isLink.Load() || len(queue) >= linkSendQ {
 				c.disconnect()
+				continue
 			}
+			queue = append(queue, line)
 		}
 	}
 
 }
 
-func (c *Client) readThread(signalChan chan signalCode) {
+//Pass the lines still queued for a link to its write thread before it
+//flushes, as far as the flush deadline allows
+func (c *Client) sendQueued(queue []string, writeChan chan string, writeDoneChan chan struct{}) {
+	if len(queue) == 0 {
+		return
+	}
+
+	timeout := time.NewTimer(time.Until(c.flushDeadline))
+	defer timeout.Stop()
+	for _, line := range queue {
+		select {
+		case writeChan <- line:
+		case <-writeDoneChan:
+			return
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+func (c *Client) readThread(signalChan chan signalCode, doneChan chan struct{}) {
+	defer close(doneChan)
+
+	//Any partial line left over from the last read
+	var pending []byte
+	//Set while skipping the rest of a line that grew too long
+	var skipping bool
+
 	for {
 		select {
 		case signal := <-signalChan:
@@ -264,40 +868,127 @@ func (c *Client) readThread(signalChan chan signalCode) {
 				return
 			}
 		default:
-			c.connection.SetReadDeadline(time.Now().Add(time.Second * 3))
+			conn := c.conn()
+			conn.SetReadDeadline(time.Now().Add(time.Second * 3))
 			buf := make([]byte, 512)
-			ln, err := c.connection.Read(buf)
+			ln, err := conn.Read(buf)
 			if err != nil {
-				if err == io.EOF {
-					c.disconnect()
-					return
+				//Timeouts just give us a chance to check for signals, anything
+				//else means the connection is gone
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					continue
 				}
-				continue
+				c.disconnect()
+				return
 			}
 
-			rawLines := buf[:ln]
+			rawLines := append(pending, buf[:ln]...)
 			rawLines = bytes.Replace(rawLines, []byte("\r\n"), []byte("\n"), -1)
 			rawLines = bytes.Replace(rawLines, []byte("\r"), []byte("\n"), -1)
 			lines := bytes.Split(rawLines, []byte("\n"))
+
+			//The last line is incomplete, or empty if the read ended a line
+			pending = append([]byte(nil), lines[len(lines)-1]...)
+			lines = lines[:len(lines)-1]
+			if skipping {
+				//Everything up to the next line ending is the rest of the
+				//line that was too long
+				if len(lines) == 0 {
+					pending = nil
+				} else {
+					lines = lines[1:]
+					skipping = false
+				}
+			}
+			if len(pending) > maxLineLength {
+				pending = nil
+				skipping = true
+			}
+
 			for _, line := range lines {
 				if len(line) > 0 {
 					c.server.eventChan <- Event{client: c, event: command, input: string(line)}
+
+					if commandName(string(line)) == "STARTTLS" {
+						//Anything read from now on may be a TLS handshake, so
+						//wait to hear whether we're switching over
+						switched, err := c.startTLS()
+						if err != nil {
+							return
+						}
+						if switched {
+							//Whatever was sent after STARTTLS in plaintext is
+							//dropped, so it can't be passed off as coming over
+							//TLS
+							pending, skipping = nil, false
+							break
+						}
+					}
 				}
 			}
 		}
 	}
 }
 
-func (c *Client) writeThread(signalChan chan signalCode, outputChan chan string) {
+//Upgrade the connection to TLS if the server accepted a STARTTLS command,
+//returning whether it did. The client is disconnected if the handshake fails.
+func (c *Client) startTLS() (bool, error) {
+	config := <-c.starttlsChan
+	if config == nil {
+		return false, nil
+	}
+
+	conn := c.conn()
+	tlsConn := tls.Server(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(time.Second * 30))
+	if err := tlsConn.Handshake(); err != nil {
+		c.disconnect()
+		return false, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	c.connMutex.Lock()
+	c.connection = tlsConn
+	c.connMutex.Unlock()
+	return true, nil
+}
+
+//The connection, which may be replaced by STARTTLS
+func (c *Client) conn() net.Conn {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	return c.connection
+}
+
+func (c *Client) writeThread(signalChan chan signalCode, outputChan chan string, doneChan chan struct{}) {
+	defer close(doneChan)
+
 	for {
 		select {
 		case signal := <-signalChan:
 			if signal == signalStop {
 				return
 			}
+			if signal == signalFlush {
+				//Write out whatever is left in the queue, without blocking
+				//beyond the deadline
+				conn := c.conn()
+				conn.SetWriteDeadline(c.flushDeadline)
+				for {
+					select {
+					case output := <-outputChan:
+						if _, err := fmt.Fprintf(conn, "%s\r\n", output); err != nil {
+							return
+						}
+					default:
+						return
+					}
+				}
+			}
 		case output := <-outputChan:
-			c.connection.SetWriteDeadline(time.Now().Add(time.Second * 30))
-			if _, err := fmt.Fprintf(c.connection, "%s\r\n", output); err != nil {
+			conn := c.conn()
+			conn.SetWriteDeadline(time.Now().Add(time.Second * 30))
+			if _, err := fmt.Fprintf(conn, "%s\r\n", output); err != nil {
 				c.disconnect()
 				return
 			}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+//Commands sent straight after a refused STARTTLS are still handled
+func TestStartTLSRefused(t *testing.T) {
+	s := startServer(t, "a.test")
+
+	c := dial(t, s.plainAddr)
+	c.send("STARTTLS\r\nNICK amy\r\nUSER amy 0 * :amy")
+	c.expect(" 691 ")
+	c.expect(" 001 amy ")
+}
+
+//A STARTTLS that never reaches the command handler doesn't leave the
+//connection waiting for the handshake
+func TestStartTLSInvalidUTF8(t *testing.T) {
+	s := startServer(t, "a.test")
+	s.utf8Policy = "reject"
+
+	c := dial(t, s.plainAddr)
+	c.send("STARTTLS \xff")
+	c.expect("INVALID_UTF8")
+	c.send("NICK amy\r\nUSER amy 0 * :amy")
+	c.expect(" 001 amy ")
+}
+
+//Links can't ask for STARTTLS, and carry on if they do
+func TestStartTLSFromLink(t *testing.T) {
+	s := startServer(t, "a.test")
+	amy := dialClient(t, s.plainAddr, "amy")
+
+	services := linkServices(t, s)
+	services.send("STARTTLS")
+	services.send(":services.test ACCOUNT amy amy")
+	amy.expect(" 900 ")
+}
+
+//Plaintext sent after an accepted STARTTLS is dropped rather than handled as
+//if it came over TLS
+func TestStartTLSDropsPlaintext(t *testing.T) {
+	s := startServer(t, "a.test")
+	l, err := s.Listen("plain://127.0.0.1:0?starttls=1", s.tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	c := dial(t, l.listener.Addr().String())
+	c.send("STARTTLS\r\nNICK evil")
+	c.expect(" 670 ")
+
+	conn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	c.send("USER amy 0 * :amy\r\nNICK amy")
+	if line := c.expect(" 001 "); !strings.Contains(line, " 001 amy ") {
+		t.Errorf("the plaintext NICK should have been dropped, got %q", line)
+	}
+}
+
+//The rest of a line that's too long is dropped along with the start of it,
+//rather than being handled as a command of its own
+func TestLongLineSkipped(t *testing.T) {
+	s := startServer(t, "a.test")
+	amy := dialClient(t, s.plainAddr, "amy")
+	amy.send("PING welcome")
+	amy.expect(" PONG ")
+
+	amy.send("PRIVMSG amy :" + strings.Repeat("a", maxLineLength*3))
+	amy.send("PING marker")
+	amy.expect(" PONG ")
+	if amy.last != "" {
+		t.Errorf("nothing should have come before the PONG, got %q", amy.last)
+	}
+}
+
+//A long message that isn't valid UTF-8 is still split to be relayed, rather
+//than taking the server down
+func TestInvalidUTF8MessageSplit(t *testing.T) {
+	s := startServer(t, "a.test")
+	amy := dialClient(t, s.plainAddr, "amy")
+	bob := dialClient(t, s.plainAddr, "bob")
+
+	amy.send("PRIVMSG bob :" + strings.Repeat("\x80", 496))
+	bob.expect("PRIVMSG bob :")
+	amy.send("PING alive")
+	amy.expect(" PONG ")
+}
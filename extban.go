@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//Extbans are list entries that match users by something other than their
+//nick and username, written $type or $type:param. ~ may be used in place of
+//$, and $~type matches everyone the type doesn't.
+const extbanPrefix = '$'
+
+//A kind of extban. Matchers are registered by type, so more can be added.
+type extban struct {
+	param string //"required", "optional" or "none"
+	match func(c *Client, param string) bool
+}
+
+var extbans = make(map[rune]extban)
+
+func registerExtban(kind rune, param string, match func(c *Client, param string) bool) {
+	extbans[kind] = extban{param, match}
+}
+
+func init() {
+	//$a matches users logged in to an account, or any account without one
+	registerExtban('a', "optional", func(c *Client, param string) bool {
+		if param == "" {
+			return c.account != ""
+		}
+		return c.account != "" && matchWildcard(strings.ToLower(param), strings.ToLower(c.account))
+	})
+
+	//$r matches realnames
+	registerExtban('r', "required", func(c *Client, param string) bool {
+		return matchWildcard(strings.ToLower(param), strings.ToLower(c.realname))
+	})
+
+	//$j matches users banned from another channel. The $j entries on its own
+	//lists aren't followed, so channels can't send matching round in circles.
+	registerExtban('j', "required", func(c *Client, param string) bool {
+		channel, exists := c.server.channelMap[c.server.casefold(param)]
+		if !exists {
+			return false
+		}
+		return c.matchesEntries(channel.lists['b'], false) && !c.matchesEntries(channel.lists['e'], false)
+	})
+
+	//$z matches users connected with TLS
+	registerExtban('z', "none", func(c *Client, param string) bool {
+		return c.secure()
+	})
+
+	//$x matches nick!user@host#realname
+	registerExtban('x', "required", func(c *Client, param string) bool {
+		hash := strings.IndexByte(param, '#')
+		if hash == -1 {
+			return false
+		}
+		return c.matchesHostmask(normalizeMask(param[:hash])) && matchWildcard(strings.ToLower(param[hash+1:]), strings.ToLower(c.realname))
+	})
+
+	//$c matches members of a channel, or those of at least a rank in it when
+	//the channel is given with its prefix, eg. $c:@#channel. Rank prefixes
+	//that are also channel types, like & and +, are only taken as ranks when
+	//a channel name follows them.
+	registerExtban('c', "required", func(c *Client, param string) bool {
+		if param == "" {
+			return false
+		}
+		least := rankNone
+		if r, isRank := c.server.rankForPrefix(rune(param[0])); isRank &&
+			len(param) > 1 && strings.ContainsRune(c.server.chanTypes, rune(param[1])) {
+			least, param = r, param[1:]
+		}
+		channel, exists := c.server.channelMap[c.server.casefold(param)]
+		if !exists {
+			return false
+		}
+		clientMode, inChannel := channel.modeMap[c.key]
+		return inChannel && clientMode.highest() >= least
+	})
+}
+
+//Split a mask into the parts of an extban, if it is one: its type, its
+//parameter and whether it's negated
+func parseExtban(mask string) (rune, string, bool, bool) {
+	if len(mask) < 2 || (mask[0] != extbanPrefix && mask[0] != '~') {
+		return 0, "", false, false
+	}
+
+	rest := mask[1:]
+	negated := strings.HasPrefix(rest, "~")
+	rest = strings.TrimPrefix(rest, "~")
+	if rest == "" {
+		return 0, "", false, false
+	}
+
+	kind, param := rune(rest[0]), ""
+	switch {
+	case len(rest) == 1:
+	case rest[1] == ':':
+		param = rest[2:]
+	default:
+		return 0, "", false, false
+	}
+	return kind, param, negated, true
+}
+
+//Why an extban isn't valid, or "" if it is or the mask isn't one
+func checkExtban(mask string) string {
+	kind, param, _, isExtban := parseExtban(mask)
+	if !isExtban {
+		if strings.HasPrefix(mask, string(extbanPrefix)) {
+			return "Extbans are of the form $type or $type:param"
+		}
+		return ""
+	}
+
+	e, known := extbans[kind]
+	switch {
+	case !known:
+		return fmt.Sprintf("Unknown extban type %c", kind)
+	case e.param == "required" && param == "":
+		return fmt.Sprintf("Extban type %c needs a parameter", kind)
+	case e.param == "none" && param != "":
+		return fmt.Sprintf("Extban type %c doesn't take a parameter", kind)
+	}
+	return ""
+}
+
+//Why a mask can't go on one of a channel's lists, or "" if it can
+func (s *Server) checkMask(channel *Channel, mask string) string {
+	mask = strings.TrimPrefix(mask, quietPrefix)
+	if reason := checkExtban(mask); reason != "" {
+		return reason
+	}
+	if kind, param, _, _ := parseExtban(mask); kind == 'j' && s.casefold(param) == s.casefold(channel.name) {
+		return "Extbans can't name the channel they're on"
+	}
+	return ""
+}
+
+//Write an extban the way it's kept, with $ as its prefix
+func normalizeExtban(mask string) string {
+	kind, param, negated, _ := parseExtban(mask)
+	normal := string(extbanPrefix)
+	if negated {
+		normal += "~"
+	}
+	normal += string(kind)
+	if param != "" {
+		normal += ":" + param
+	}
+	return normal
+}
+
+//Whether the client matches an extban
+func (c *Client) matchesExtban(mask string) bool {
+	kind, param, negated, _ := parseExtban(mask)
+	e, known := extbans[kind]
+	if !known {
+		return false
+	}
+	return e.match(c, param) != negated
+}
+
+//The EXTBAN token, listing the prefix and the types that may be used
+func extbanToken() string {
+	kinds := make([]string, 0, len(extbans))
+	for kind := range extbans {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+	return fmt.Sprintf("EXTBAN=%c,%s", extbanPrefix, strings.Join(kinds, ""))
+}
+
+//Whether the client is connected with TLS. An always-on client is when all of
+//its connections are. Only users of this server are known to be.
+func (c *Client) secure() bool {
+	if !c.persistent {
+		return c.tls
+	}
+	for _, conn := range c.attached {
+		if !conn.tls {
+			return false
+		}
+	}
+	return len(c.attached) > 0
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"testing"
+)
+
+//A server that isn't running, for testing matchers directly
+func testMatchServer() *Server {
+	s := NewServer()
+	s.chanTypes = "#&+"
+	return s
+}
+
+//Add a client to a channel, creating either if need be, with a rank in it
+func testMember(s *Server, nick, channelName string, r rank) *Client {
+	c, exists := s.clientMap[s.casefold(nick)]
+	if !exists {
+		c = &Client{server: s,
+			nick:       nick,
+			key:        s.casefold(nick),
+			username:   nick,
+			address:    "192.0.2.1",
+			registered: true,
+			channelMap: make(map[string]*Channel),
+			caps:       make(map[string]bool)}
+		s.addClient(c)
+	}
+
+	channel, exists := s.channelMap[s.casefold(channelName)]
+	if !exists {
+		channel = s.newChannel(channelName, ChannelMode{})
+	}
+
+	mode := new(ClientMode)
+	if r != rankNone {
+		mode.set(r, true)
+	}
+	channel.clientMap[c.key] = c
+	channel.modeMap[c.key] = mode
+	c.channelMap[s.casefold(channelName)] = channel
+	return c
+}
+
+func TestChannelExtban(t *testing.T) {
+	s := testMatchServer()
+	amy := testMember(s, "amy", "&local", rankNone)
+	testMember(s, "amy", "+modeless", rankNone)
+	testMember(s, "amy", "#ops", rankOperator)
+	testMember(s, "amy", "#voiced", rankVoice)
+
+	tests := []struct {
+		mask string
+		want bool
+	}{
+		{"$c:&local", true},
+		{"$c:+modeless", true},
+		{"$c:#ops", true},
+		{"$c:@#ops", true},
+		{"$c:&#ops", false},
+		{"$c:+#voiced", true},
+		{"$c:%#voiced", false},
+		{"$c:&&local", false},
+		{"$c:++modeless", false},
+		{"$c:#nowhere", false},
+		{"$~c:&local", false},
+	}
+
+	for _, test := range tests {
+		if got := amy.matchesExtban(test.mask); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.mask, got, test.want)
+		}
+	}
+}
+
+func TestParseExtban(t *testing.T) {
+	tests := []struct {
+		mask    string
+		kind    rune
+		param   string
+		negated bool
+		ok      bool
+	}{
+		{"$a", 'a', "", false, true},
+		{"$a:amy", 'a', "amy", false, true},
+		{"~a:amy", 'a', "amy", false, true},
+		{"$~a:amy", 'a', "amy", true, true},
+		{"~~z", 'z', "", true, true},
+		{"$a:", 'a', "", false, true},
+		{"$x:amy!*@*#Amy Pond", 'x', "amy!*@*#Amy Pond", false, true},
+		{"$", 0, "", false, false},
+		{"$~", 0, "", false, false},
+		{"$amy", 0, "", false, false},
+		{"amy!*@*", 0, "", false, false},
+	}
+
+	for _, test := range tests {
+		kind, param, negated, ok := parseExtban(test.mask)
+		if kind != test.kind || param != test.param || negated != test.negated || ok != test.ok {
+			t.Errorf("%s: got %q, %q, %t, %t", test.mask, kind, param, negated, ok)
+		}
+	}
+}
+
+func TestCheckMask(t *testing.T) {
+	s := testMatchServer()
+	channel := s.newChannel("#Test", ChannelMode{})
+	tests := []struct {
+		mask  string
+		valid bool
+	}{
+		{"amy!*@*", true},
+		{"$a", true},
+		{"$a:amy", true},
+		{"$r", false},
+		{"$r:*bot*", true},
+		{"$z", true},
+		{"$z:yes", false},
+		{"$q:amy", false},
+		{"$amy", false},
+		{"$", false},
+		{"~q:$a:amy", true},
+		{"~q:$r", false},
+		{"$j:#other", true},
+		{"$j:#test", false},
+		{"$~j:#TEST", false},
+	}
+
+	for _, test := range tests {
+		if reason := s.checkMask(channel, test.mask); (reason == "") != test.valid {
+			t.Errorf("%s: got %q", test.mask, reason)
+		}
+	}
+}
+
+func TestExtbanMatch(t *testing.T) {
+	s := testMatchServer()
+	amy := testMember(s, "amy", "#test", rankNone)
+	amy.account = "Amy"
+	amy.realname = "Amy Pond"
+	amy.tls = true
+	rory := testMember(s, "rory", "#test", rankNone)
+	rory.realname = "Rory Williams"
+
+	//Channels banning each other by $j, which are only followed one step
+	testMember(s, "river", "#a", rankNone)
+	testMember(s, "river", "#b", rankNone)
+	s.channelMap["#a"].lists['b'] = []listEntry{{mask: "$j:#b"}}
+	s.channelMap["#b"].lists['b'] = []listEntry{{mask: "$j:#a"}, {mask: "amy!*@*"}}
+	s.channelMap["#b"].lists['e'] = []listEntry{{mask: "$r:*Williams"}}
+
+	tests := []struct {
+		c    *Client
+		mask string
+		want bool
+	}{
+		{amy, "$a", true},
+		{rory, "$a", false},
+		{amy, "$a:amy", true},
+		{amy, "$a:a*", true},
+		{amy, "$a:rory", false},
+		{rory, "$~a", true},
+		{amy, "$r:amy*", true},
+		{amy, "$r:*Williams", false},
+		{amy, "$z", true},
+		{rory, "$z", false},
+		{amy, "$x:amy!*@*#*Pond", true},
+		{amy, "$x:amy!*@*#*Williams", false},
+		{amy, "$x:amy!*@*", false},
+		{amy, "$j:#b", true},
+		{rory, "$j:#b", false},
+		{amy, "$j:#nowhere", false},
+		{amy, "$j:#a", false},
+		{amy, "$y:amy", false},
+	}
+
+	for _, test := range tests {
+		if got := test.c.matchesExtban(test.mask); got != test.want {
+			t.Errorf("%s against %s: got %t, want %t", test.mask, test.c.nick, got, test.want)
+		}
+	}
+
+	if !amy.banned(s.channelMap["#a"]) || rory.banned(s.channelMap["#a"]) {
+		t.Error("bans should be followed one step through $j")
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Most messages a client can ask for at once
+const historyQueryLimit = 100
+
+//How many messages to replay on join to clients without draft/chathistory
+const historyReplayLength = 20
+
+//The messages kept for a channel with history enabled. Channels listed in
+//-irc-history-keep keep their history, and so the +H mode, when they're
+//emptied and recreated. Others forget it, so whoever recreates them can't
+//read what was said before.
+type channelHistory struct {
+	Name     string
+	Created  int64 //When the channel was created, kept for when it's recreated
+	Messages []historyMessage
+}
+
+type historyMessage struct {
+	ID     string
+	Time   time.Time
+	Source string
+	Target string
+	Text   string
+}
+
+//The tags to send a message with when replaying it
+func (m *historyMessage) tags() map[string]string {
+	return map[string]string{"msgid": m.ID, "time": formatTime(m.Time)}
+}
+
+//Drop messages beyond the limits. They're dropped by moving the start of the
+//slice along, so nothing is copied until add runs out of room.
+func (h *channelHistory) prune(limit int, age time.Duration) {
+	if len(h.Messages) > limit {
+		h.Messages = h.Messages[len(h.Messages)-limit:]
+	}
+
+	if age > 0 {
+		cutoff := time.Now().Add(-age)
+		i := sort.Search(len(h.Messages), func(i int) bool {
+			return h.Messages[i].Time.After(cutoff)
+		})
+		h.Messages = h.Messages[i:]
+	}
+}
+
+//Turn history for a channel on or off. Turning it off forgets everything.
+func (s *Server) setHistory(channel *Channel, enabled bool) {
+	channel.mode.setFlag('H', enabled)
+
+	key := s.casefold(channel.name)
+	if !enabled {
+		delete(s.historyMap, key)
+	} else if _, exists := s.historyMap[key]; !exists {
+		s.historyMap[key] = &channelHistory{Name: channel.name, Created: channel.created}
+	}
+}
+
+//Whether a channel keeps its history when everyone leaves it
+func (s *Server) keepsHistory(name string) bool {
+	for _, keep := range s.historyKeep {
+		if s.casefold(keep) == s.casefold(name) {
+			return true
+		}
+	}
+	return false
+}
+
+//Keep a message sent to a channel, if it has history enabled
+func (s *Server) addHistory(channel *Channel, message historyMessage) {
+	history, exists := s.historyMap[s.casefold(channel.name)]
+	if !exists {
+		return
+	}
+
+	history.add(message)
+	history.prune(s.historyLimit, s.historyAge)
+}
+
+//Add a message to the end of the history. When the array runs out of room,
+//what's kept is copied to one with room for as many messages again, so each
+//message is only copied about once however many are added.
+func (h *channelHistory) add(message historyMessage) {
+	if len(h.Messages) == cap(h.Messages) {
+		messages := make([]historyMessage, len(h.Messages), 2*len(h.Messages)+1)
+		copy(messages, h.Messages)
+		h.Messages = messages
+	}
+	h.Messages = append(h.Messages, message)
+}
+
+func (s *Server) loadHistory() error {
+	data, err := os.ReadFile(s.historyFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var histories []*channelHistory
+	if err := json.Unmarshal(data, &histories); err != nil {
+		return err
+	}
+
+	for _, history := range histories {
+		//Every channel is empty after a restart
+		if !s.keepsHistory(history.Name) {
+			continue
+		}
+		history.prune(s.historyLimit, s.historyAge)
+		s.historyMap[s.casefold(history.Name)] = history
+	}
+	return nil
+}
+
+//Write history to disk, if configured to. Called by the event loop.
+func (s *Server) saveHistory() error {
+	if s.historyFile == "" {
+		return nil
+	}
+
+	histories := make([]*channelHistory, 0, len(s.historyMap))
+	for _, history := range s.historyMap {
+		history.prune(s.historyLimit, s.historyAge)
+		histories = append(histories, history)
+	}
+
+	data, err := json.Marshal(histories)
+	if err != nil {
+		return err
+	}
+
+	//Write a new file then move it into place, so a crash can't leave us
+	//with half of one
+	tmp := s.historyFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.historyFile)
+}
+
+//Write history to disk every interval until the server shuts down, so
+//crashing loses no more than that
+func (s *Server) autosaveHistory(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.isShuttingDown() {
+			return
+		}
+		s.eventChan <- Event{event: save}
+	}
+}
+
+//Send the latest messages in a channel to a client that just joined and
+//can't ask for them itself
+func (c *Client) replayHistory(channel *Channel) {
+	history, exists := c.server.historyMap[c.server.casefold(channel.name)]
+	if !exists || len(history.Messages) == 0 {
+		return
+	}
+
+	messages := history.Messages
+	if len(messages) > historyReplayLength {
+		messages = messages[len(messages)-historyReplayLength:]
+	}
+	c.sendHistory(channel.name, messages)
+}
+
+//Send messages from history, in a chathistory batch if the client supports
+//them
+func (c *Client) sendHistory(target string, messages []historyMessage) {
+	ref := c.startBatch("chathistory", target)
+	for i := range messages {
+		m := &messages[i]
+		c.replyTags(batchTags(ref, m.tags()), rplMsg, m.Source, m.Target, m.Text)
+	}
+	c.endBatch(ref)
+}
+
+//A position in a channel's history, given as * , timestamp=... or msgid=...
+type historyRef struct {
+	latest bool
+	time   time.Time
+	msgid  string
+}
+
+func parseHistoryRef(ref string, allowLatest bool) (historyRef, bool) {
+	if ref == "*" {
+		return historyRef{latest: true}, allowLatest
+	}
+
+	kind, value, ok := strings.Cut(ref, "=")
+	if !ok {
+		return historyRef{}, false
+	}
+
+	switch kind {
+	case "timestamp":
+		t, err := time.Parse(timeFormat, value)
+		if err != nil {
+			//Allow for clients that don't send milliseconds
+			if t, err = time.Parse(time.RFC3339, value); err != nil {
+				return historyRef{}, false
+			}
+		}
+		return historyRef{time: t}, true
+	case "msgid":
+		return historyRef{msgid: value}, value != ""
+	}
+	return historyRef{}, false
+}
+
+//The index of the first message after ref
+func (r historyRef) after(messages []historyMessage) int {
+	if r.msgid != "" {
+		for i := range messages {
+			if messages[i].ID == r.msgid {
+				return i + 1
+			}
+		}
+		return len(messages)
+	}
+	return sort.Search(len(messages), func(i int) bool {
+		return messages[i].Time.After(r.time)
+	})
+}
+
+//The index of the first message that isn't before ref
+func (r historyRef) before(messages []historyMessage) int {
+	if r.msgid != "" {
+		for i := range messages {
+			if messages[i].ID == r.msgid {
+				return i
+			}
+		}
+		return 0
+	}
+	return sort.Search(len(messages), func(i int) bool {
+		return !messages[i].Time.Before(r.time)
+	})
+}
+
+//Handle CHATHISTORY, as described by the IRCv3 draft/chathistory spec
+func (s *Server) chatHistory(client *Client, args []string) {
+	subcommand := strings.ToUpper(args[0])
+	if subcommand == "TARGETS" {
+		s.chatHistoryTargets(client, args)
+		return
+	}
+
+	want := map[string]int{"LATEST": 4, "BEFORE": 4, "AFTER": 4, "AROUND": 4, "BETWEEN": 5}
+	n, known := want[subcommand]
+	if !known {
+		client.reply(rplFail, "CHATHISTORY", "UNKNOWN_COMMAND", subcommand, "Unknown subcommand")
+		return
+	}
+	if len(args) < n {
+		client.reply(rplFail, "CHATHISTORY", "INVALID_PARAMS", subcommand, "Not enough parameters")
+		return
+	}
+
+	limit, err := strconv.Atoi(args[n-1])
+	if err != nil || limit < 1 {
+		client.reply(rplFail, "CHATHISTORY", "INVALID_PARAMS", subcommand, "Invalid limit")
+		return
+	}
+	if limit > historyQueryLimit {
+		limit = historyQueryLimit
+	}
+
+	ref, ok := parseHistoryRef(args[2], subcommand == "LATEST")
+	var ref2 historyRef
+	if ok && subcommand == "BETWEEN" {
+		ref2, ok = parseHistoryRef(args[3], false)
+	}
+	if !ok {
+		client.reply(rplFail, "CHATHISTORY", "INVALID_PARAMS", subcommand, "Invalid message reference")
+		return
+	}
+
+	target := args[1]
+	channel, exists := s.channelMap[s.casefold(target)]
+	history, hasHistory := s.historyMap[s.casefold(target)]
+	if exists {
+		_, exists = channel.clientMap[client.key]
+	}
+	if !exists || !hasHistory {
+		client.reply(rplFail, "CHATHISTORY", "INVALID_TARGET", subcommand+" "+target, "No history for that target")
+		return
+	}
+
+	messages := history.Messages
+	lo, hi := historyRange(subcommand, ref, ref2, limit, messages)
+	client.sendHistory(channel.name, messages[lo:hi])
+}
+
+//The range of messages a CHATHISTORY subcommand asks for, as the index of the
+//first and one past the last
+func historyRange(subcommand string, ref, ref2 historyRef, limit int, messages []historyMessage) (int, int) {
+	lo, hi := 0, len(messages)
+	switch subcommand {
+	case "LATEST":
+		if !ref.latest {
+			lo = ref.after(messages)
+		}
+		lo = max(lo, hi-limit)
+	case "BEFORE":
+		hi = ref.before(messages)
+		lo = max(0, hi-limit)
+	case "AFTER":
+		lo = ref.after(messages)
+		hi = min(hi, lo+limit)
+	case "AROUND":
+		lo = max(0, ref.before(messages)-limit/2)
+		hi = min(hi, lo+limit)
+	case "BETWEEN":
+		if ref.before(messages) <= ref2.before(messages) {
+			lo, hi = ref.after(messages), ref2.before(messages)
+			hi = min(hi, lo+limit)
+		} else {
+			lo, hi = ref2.after(messages), ref.before(messages)
+			lo = max(lo, hi-limit)
+		}
+	}
+	if lo > hi {
+		lo = hi
+	}
+	return lo, hi
+}
+
+//Handle CHATHISTORY TARGETS, listing the channels the client is in that have
+//had messages between two times
+func (s *Server) chatHistoryTargets(client *Client, args []string) {
+	if len(args) < 4 {
+		client.reply(rplFail, "CHATHISTORY", "INVALID_PARAMS", "TARGETS", "Not enough parameters")
+		return
+	}
+
+	from, ok1 := parseHistoryRef(args[1], false)
+	to, ok2 := parseHistoryRef(args[2], false)
+	limit, err := strconv.Atoi(args[3])
+	if !ok1 || !ok2 || from.msgid != "" || to.msgid != "" || err != nil || limit < 1 {
+		client.reply(rplFail, "CHATHISTORY", "INVALID_PARAMS", "TARGETS", "Invalid parameters")
+		return
+	}
+	if from.time.After(to.time) {
+		from, to = to, from
+	}
+
+	type target struct {
+		name   string
+		latest time.Time
+	}
+	var targets []target
+	for key, channel := range client.channelMap {
+		history, exists := s.historyMap[key]
+		if !exists || len(history.Messages) == 0 {
+			continue
+		}
+
+		latest := history.Messages[len(history.Messages)-1].Time
+		if latest.After(from.time) && latest.Before(to.time) {
+			targets = append(targets, target{channel.name, latest})
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].latest.Before(targets[j].latest)
+	})
+	if len(targets) > min(limit, historyQueryLimit) {
+		targets = targets[:min(limit, historyQueryLimit)]
+	}
+
+	ref := client.startBatch("draft/chathistory-targets")
+	for _, t := range targets {
+		client.replyTags(batchTags(ref, nil), rplHistoryTarget, t.name, formatTime(t.latest))
+	}
+	client.endBatch(ref)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Fill a history with n messages, a second apart and ending now, with their
+//index as their ID
+func testHistory(n int) *channelHistory {
+	h := &channelHistory{Name: "#test"}
+	start := time.Now().Add(-time.Duration(n-1) * time.Second)
+	for i := 0; i < n; i++ {
+		h.add(historyMessage{ID: strconv.Itoa(i), Time: start.Add(time.Duration(i) * time.Second)})
+	}
+	return h
+}
+
+func TestHistoryPrune(t *testing.T) {
+	tests := []struct {
+		n       int
+		limit   int
+		age     time.Duration
+		first   string
+		kept    int
+		comment string
+	}{
+		{10, 100, 0, "0", 10, "under the limit"},
+		{10, 10, 0, "0", 10, "at the limit"},
+		{10, 4, 0, "6", 4, "over the limit"},
+		{10, 100, time.Minute, "0", 10, "none too old"},
+		{120, 100, time.Minute, "60", 60, "age beats the limit"},
+		{120, 30, time.Minute, "90", 30, "limit beats the age"},
+	}
+
+	for _, test := range tests {
+		h := testHistory(test.n)
+		h.prune(test.limit, test.age)
+		first := ""
+		if len(h.Messages) > 0 {
+			first = h.Messages[0].ID
+		}
+		if len(h.Messages) != test.kept || first != test.first {
+			t.Errorf("%s: kept %d from %q, want %d from %q", test.comment, len(h.Messages), first, test.kept, test.first)
+		}
+	}
+}
+
+//Once a channel's history is full, adding a message doesn't copy all the
+//others each time
+func TestHistoryAddCopies(t *testing.T) {
+	const limit, n = 100, 10000
+
+	h := &channelHistory{Name: "#test"}
+	copies := 0
+	for i := 0; i < n; i++ {
+		before := cap(h.Messages)
+		h.add(historyMessage{ID: strconv.Itoa(i), Time: time.Now()})
+		if cap(h.Messages) > before {
+			copies++
+		}
+		h.prune(limit, 0)
+	}
+
+	if len(h.Messages) != limit || h.Messages[0].ID != strconv.Itoa(n-limit) {
+		t.Fatalf("kept %d from %q, want the last %d", len(h.Messages), h.Messages[0].ID, limit)
+	}
+	if copies > 2*n/limit {
+		t.Errorf("history was copied %d times for %d messages", copies, n)
+	}
+}
+
+func TestParseHistoryRef(t *testing.T) {
+	tests := []struct {
+		ref         string
+		allowLatest bool
+		want        historyRef
+		ok          bool
+	}{
+		{"*", true, historyRef{latest: true}, true},
+		{"*", false, historyRef{latest: true}, false},
+		{"msgid=abc", false, historyRef{msgid: "abc"}, true},
+		{"msgid=", false, historyRef{}, false},
+		{"timestamp=2026-10-18T12:00:00.123Z", false,
+			historyRef{time: time.Date(2026, 10, 18, 12, 0, 0, 123e6, time.UTC)}, true},
+		{"timestamp=2026-10-18T12:00:00Z", false,
+			historyRef{time: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)}, true},
+		{"timestamp=2026-10-18T13:00:00+01:00", false,
+			historyRef{time: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)}, true},
+		{"timestamp=yesterday", false, historyRef{}, false},
+		{"timestamp=", false, historyRef{}, false},
+		{"abc", false, historyRef{}, false},
+		{"other=abc", false, historyRef{}, false},
+	}
+
+	for _, test := range tests {
+		got, ok := parseHistoryRef(test.ref, test.allowLatest)
+		if ok != test.ok {
+			t.Errorf("%s: got ok %t", test.ref, ok)
+			continue
+		}
+		if ok && (got.latest != test.want.latest || got.msgid != test.want.msgid || !got.time.Equal(test.want.time)) {
+			t.Errorf("%s: got %+v, want %+v", test.ref, got, test.want)
+		}
+	}
+}
+
+func TestHistoryRange(t *testing.T) {
+	h := testHistory(10)
+	id := func(i string) historyRef { return historyRef{msgid: i} }
+	at := func(i int) historyRef { return historyRef{time: h.Messages[i].Time} }
+
+	tests := []struct {
+		subcommand string
+		ref, ref2  historyRef
+		limit      int
+		ids        string
+	}{
+		{"LATEST", historyRef{latest: true}, historyRef{}, 3, "7 8 9"},
+		{"LATEST", historyRef{latest: true}, historyRef{}, 100, "0 1 2 3 4 5 6 7 8 9"},
+		{"LATEST", id("5"), historyRef{}, 10, "6 7 8 9"},
+		{"LATEST", id("5"), historyRef{}, 2, "8 9"},
+		{"LATEST", at(5), historyRef{}, 10, "6 7 8 9"},
+		{"BEFORE", id("5"), historyRef{}, 3, "2 3 4"},
+		{"BEFORE", id("1"), historyRef{}, 3, "0"},
+		{"BEFORE", id("0"), historyRef{}, 3, ""},
+		{"BEFORE", at(5), historyRef{}, 3, "2 3 4"},
+		{"AFTER", id("5"), historyRef{}, 3, "6 7 8"},
+		{"AFTER", id("9"), historyRef{}, 3, ""},
+		{"AFTER", at(5), historyRef{}, 3, "6 7 8"},
+		{"AROUND", id("5"), historyRef{}, 4, "3 4 5 6"},
+		{"AROUND", id("0"), historyRef{}, 4, "0 1 2 3"},
+		{"AROUND", id("9"), historyRef{}, 4, "7 8 9"},
+		{"BETWEEN", id("2"), id("7"), 10, "3 4 5 6"},
+		{"BETWEEN", id("2"), id("7"), 2, "3 4"},
+		{"BETWEEN", id("7"), id("2"), 2, "5 6"},
+		{"BETWEEN", at(2), at(7), 10, "3 4 5 6"},
+		{"BETWEEN", id("5"), id("5"), 10, ""},
+		{"AFTER", id("missing"), historyRef{}, 3, ""},
+		{"BEFORE", id("missing"), historyRef{}, 3, ""},
+		{"BETWEEN", id("missing"), id("7"), 10, ""},
+	}
+
+	for _, test := range tests {
+		lo, hi := historyRange(test.subcommand, test.ref, test.ref2, test.limit, h.Messages)
+		var ids []string
+		for _, m := range h.Messages[lo:hi] {
+			ids = append(ids, m.ID)
+		}
+		if got := strings.Join(ids, " "); got != test.ids {
+			t.Errorf("%s %+v %+v %d: got %q, want %q", test.subcommand, test.ref, test.ref2, test.limit, got, test.ids)
+		}
+	}
+}
+
+//History is written to disk as the server runs, not just when it shuts down
+func TestHistoryAutosave(t *testing.T) {
+	s := startServer(t, "a.test")
+	s.historyLimit = 10
+	s.historyFile = filepath.Join(t.TempDir(), "history.json")
+	go s.autosaveHistory(time.Millisecond * 50)
+
+	amy := dialClient(t, s.plainAddr, "amy")
+	amy.send("JOIN #saved")
+	amy.expect(" 366 ")
+	amy.send("MODE #saved +H")
+	amy.expect("MODE #saved +H")
+	amy.send("PRIVMSG #saved :remember this")
+
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		if data, err := os.ReadFile(s.historyFile); err == nil && strings.Contains(string(data), "remember this") {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatal("history was never saved")
+}
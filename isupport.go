@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Most tokens to send in one RPL_ISUPPORT reply
+const isupportBatchSize = 12
+
+//The tokens sent in RPL_ISUPPORT, telling clients what the server supports
+func (s *Server) isupport() []string {
+	tokens := []string{"CHANTYPES=" + s.chanTypes,
+		s.prefixToken(),
+		s.chanModesToken(),
+		fmt.Sprintf("MODES=%d", maxModeParams),
+		fmt.Sprintf("MAXLIST=beI:%d", maxListEntries),
+		"EXCEPTS=e",
+		"INVEX=I",
+		extbanToken(),
+		"NETWORK=" + s.name,
+		"CASEMAPPING=" + s.casemapping,
+		fmt.Sprintf("NICKLEN=%d", s.nickLength),
+		fmt.Sprintf("CHANNELLEN=%d", s.channelLength),
+		fmt.Sprintf("TOPICLEN=%d", s.topicLength)}
+	if s.utf8Policy != "allow" {
+		tokens = append(tokens, "UTF8ONLY")
+	}
+	if strings.ContainsRune(s.chanTypes, '!') {
+		tokens = append(tokens, fmt.Sprintf("IDCHAN=!:%d", safeChannelIDLength))
+	}
+	if s.monitorLimit > 0 {
+		tokens = append(tokens, fmt.Sprintf("MONITOR=%d", s.monitorLimit))
+	}
+	if s.historyLimit > 0 {
+		tokens = append(tokens, fmt.Sprintf("CHATHISTORY=%d", historyQueryLimit))
+	}
+	return tokens
+}
+
+func (c *Client) sendISupport() {
+	tokens := c.server.isupport()
+	for len(tokens) > 0 {
+		n := min(len(tokens), isupportBatchSize)
+		c.reply(rplISupport, tokens[:n]...)
+		tokens = tokens[n:]
+	}
+}
@@ -0,0 +1,1031 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//How long to wait when connecting to another server
+const linkTimeout = time.Second * 10
+
+//Max number of members to burst in a single SJOIN
+const sjoinBatchSize = 20
+
+//Max number of lines queued for a link before it's dropped for falling behind
+const linkSendQ = 1 << 20
+
+//A server we're linked to, directly or through other servers. The network
+//must form a tree, so every server is reached through exactly one link.
+type Link struct {
+	name     string
+	hops     int
+	uplink   *Link   //The server it's linked to, nil if that's us
+	conn     *Client //The direct link it's reached through
+	services bool    //Trusted to act for users and channels
+}
+
+//An entry from the link file, describing a server we may link with
+type linkBlock struct {
+	name        string
+	address     string
+	password    string
+	fingerprint string //SHA-256 of the server's certificate, if pinned
+	services    bool
+}
+
+//Load the link file. The format is one server per line, giving its name,
+//address, password and optionally the SHA-256 fingerprint of its certificate,
+//and "services" if it's a services server:
+//
+//	hub.example.com 192.0.2.1:6697 secret 5f0c...
+//	services.example.com 127.0.0.1:0 secret services
+func loadLinks(path string) (map[string]*linkBlock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make(map[string]*linkBlock)
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexRune(line, '#'); i > -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 || len(fields) > 5 {
+			return nil, fmt.Errorf("invalid link %q", line)
+		}
+
+		block := &linkBlock{name: fields[0],
+			address:  fields[1],
+			password: fields[2]}
+		for _, field := range fields[3:] {
+			if field == "services" {
+				block.services = true
+			} else {
+				block.fingerprint = normalizeFingerprint(field)
+			}
+		}
+		blocks[strings.ToLower(block.name)] = block
+	}
+	return blocks, nil
+}
+
+//Fingerprints are compared as lower case hex without separators
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+//Whether the other end of conn presented the certificate we expect
+func (b *linkBlock) verify(conn net.Conn) bool {
+	if b.fingerprint == "" {
+		return true
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	return len(certs) > 0 && certFingerprint(certs[0].Raw) == b.fingerprint
+}
+
+//Open a link to another server. The handshake is completed by the event
+//loop once the connection is up.
+func (s *Server) connectLink(block *linkBlock) {
+	host, _, err := net.SplitHostPort(block.address)
+	if err != nil {
+		log.Printf("Could not link to %s: %s", block.name, err)
+		return
+	}
+
+	config := &tls.Config{ServerName: host,
+		MinVersion:   s.tlsConfig.MinVersion,
+		CipherSuites: s.tlsConfig.CipherSuites,
+		Certificates: s.tlsConfig.Certificates}
+
+	if block.fingerprint != "" {
+		//The pinned certificate is trusted whoever signed it
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 ||
+				certFingerprint(state.PeerCertificates[0].Raw) != block.fingerprint {
+				return errors.New("certificate fingerprint mismatch")
+			}
+			return nil
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: linkTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", block.address, config)
+	if err != nil {
+		log.Printf("Could not link to %s: %s", block.name, err)
+		return
+	}
+
+	if !s.addClientThread() {
+		conn.Close()
+		return
+	}
+
+	client := s.newClient(conn)
+	client.linkBlock = block
+	client.isLink.Store(true)
+	go client.clientThread()
+}
+
+//Handle a SERVER line, from a server connecting to us or one we connected to
+func (s *Server) acceptLink(c *Client, args []string) {
+	if len(args) < 2 {
+		c.reply(errMoreArgs)
+		return
+	}
+
+	name := args[0]
+	block, exists := s.linkBlocks[strings.ToLower(name)]
+
+	reason := ""
+	if _, ok := c.conn().(*tls.Conn); !ok {
+		reason = "Links must use TLS"
+	} else if !exists || (c.linkBlock != nil && c.linkBlock != block) ||
+		subtle.ConstantTimeCompare([]byte(args[1]), []byte(block.password)) != 1 {
+		reason = "Bad link credentials"
+	} else if !block.verify(c.conn()) {
+		reason = "Certificate fingerprint mismatch"
+	} else if _, linked := s.linkMap[strings.ToLower(name)]; linked || strings.EqualFold(name, s.name) {
+		reason = "Server already linked"
+	}
+
+	if reason != "" {
+		log.Printf("Refused link from %s: %s", name, reason)
+		c.reply(rplClosingLink, reason)
+		c.flush(time.Now().Add(linkTimeout))
+		return
+	}
+
+	if c.linkBlock == nil {
+		//They connected to us, so we still need to introduce ourselves
+		c.linkBlock = block
+		c.isLink.Store(true)
+		c.send(fmt.Sprintf("SERVER %s %s", s.name, block.password))
+	}
+
+	link := &Link{name: name, hops: 1, conn: c, services: block.services}
+	c.peer = link
+	s.linkMap[strings.ToLower(name)] = link
+
+	log.Printf("Linked to %s", name)
+
+	s.sendBurst(c)
+	s.propagateLine(c, link.sid(s))
+}
+
+//Tell a newly linked server everything we know that it doesn't
+func (s *Server) sendBurst(c *Client) {
+	//Servers must be introduced before anything behind them
+	links := make([]*Link, 0, len(s.linkMap))
+	for _, link := range s.linkMap {
+		if link.conn != c {
+			links = append(links, link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].hops < links[j].hops
+	})
+	for _, link := range links {
+		c.send(link.sid(s))
+	}
+
+	for _, client := range s.clientMap {
+		if client.registered && client.route() != c {
+			c.send(client.uid())
+			if client.away != "" {
+				c.send(fmt.Sprintf(":%s AWAY :%s", client.nick, client.away))
+			}
+		}
+	}
+
+	for _, channel := range s.channelMap {
+		if channel.local() {
+			continue
+		}
+
+		members := make([]string, 0, sjoinBatchSize)
+		for key, client := range channel.clientMap {
+			if client.route() == c {
+				continue
+			}
+
+			if len(members) == cap(members) {
+				c.send(fmt.Sprintf(":%s SJOIN %s %d %s :%s", s.name, channel.name, channel.created, channel.mode.withParams(true), strings.Join(members, " ")))
+				members = members[:0]
+			}
+			members = append(members, channel.modeMap[key].Prefixes()+client.nick)
+		}
+
+		if len(members) > 0 {
+			c.send(fmt.Sprintf(":%s SJOIN %s %d %s :%s", s.name, channel.name, channel.created, channel.mode.withParams(true), strings.Join(members, " ")))
+		}
+		if channel.topic != "" {
+			c.send(fmt.Sprintf(":%s TB %s %d %s :%s", s.name, channel.name, channel.topicTime, channel.topicSetter, channel.topic))
+		}
+		s.sendLists(c, channel)
+	}
+
+	c.send(fmt.Sprintf(":%s EOB", s.name))
+}
+
+//The SID line introducing a server to other servers
+func (l *Link) sid(s *Server) string {
+	if l.services {
+		return fmt.Sprintf(":%s SID %s %d services", s.uplinkName(l), l.name, l.hops)
+	}
+	return fmt.Sprintf(":%s SID %s %d", s.uplinkName(l), l.name, l.hops)
+}
+
+func (s *Server) uplinkName(link *Link) string {
+	if link.uplink == nil {
+		return s.name
+	}
+	return link.uplink.name
+}
+
+//The UID line introducing a client to other servers
+func (c *Client) uid() string {
+	operator := 0
+	if c.operator {
+		operator = 1
+	}
+	return fmt.Sprintf(":%s UID %s %d %s %d %s :%s", c.serverName(), c.nick, c.nickTS, c.username, operator, c.accountName(), c.realname)
+}
+
+//The name of the server the client is connected to
+func (c *Client) serverName() string {
+	if c.origin == nil {
+		return c.server.name
+	}
+	return c.origin.name
+}
+
+//The direct link that messages for the client must be sent through, or nil
+//for our own clients
+func (c *Client) route() *Client {
+	if c.origin == nil {
+		return nil
+	}
+	return c.origin.conn
+}
+
+//Send a line to every directly linked server except the one given, which
+//is usually the one the line came from
+func (s *Server) propagate(except *Client, format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	for _, link := range s.linkMap {
+		if link.uplink == nil && link.conn != except {
+			link.conn.send(line)
+		}
+	}
+}
+
+//Send a line that's already been formatted to linked servers
+func (s *Server) propagateLine(except *Client, line string) {
+	s.propagate(except, "%s", line)
+}
+
+//Look up the client a linked server says a message came from, making sure
+//it's really behind that link
+func (s *Server) linkedClient(link *Client, nick string) *Client {
+	client, exists := s.clientMap[s.casefold(nick)]
+	if !exists || client.route() != link {
+		return nil
+	}
+	return client
+}
+
+//Look up the nick or server a linked server says a message came from. Only
+//services may send messages in their server's name, so for anyone else
+//this is the same as linkedClient.
+func (s *Server) linkedSource(link *Client, source string) *Client {
+	if client := s.linkedClient(link, source); client != nil {
+		return client
+	}
+
+	server := s.linkedServer(link, source)
+	if server == nil || !server.services {
+		return nil
+	}
+
+	//A stand-in for the server, so it can do anything a client can
+	return &Client{server: s,
+		nick:       server.name,
+		key:        strings.ToLower(server.name),
+		origin:     server,
+		registered: true,
+		channelMap: make(map[string]*Channel)}
+}
+
+//Whether a message from a link came from services, either the server itself
+//or one of its pseudo-clients
+func (s *Server) fromServices(link *Client, source string) bool {
+	client := s.linkedSource(link, source)
+	return client != nil && client.isService()
+}
+
+//Whether a client is a pseudo-client introduced by services
+func (c *Client) isService() bool {
+	return c.origin != nil && c.origin.services
+}
+
+//Look up a server a linked server says a message came from, making sure it's
+//really behind that link
+func (s *Server) linkedServer(link *Client, name string) *Link {
+	server, exists := s.linkMap[strings.ToLower(name)]
+	if !exists || server.conn != link {
+		return nil
+	}
+	return server
+}
+
+//Resolve a clash between an existing client and one a linked server is
+//introducing with the same nick. The older nick survives, and if they're the
+//same age neither does, except that services always keep their nicks. Both
+//sides of the link come to the same conclusion, so only the clients on our
+//side are killed. Returns whether the newcomer survives.
+func (s *Server) collide(link *Client, existing *Client, ts int64, services bool) bool {
+	if services != existing.isService() {
+		if services {
+			s.kill(existing, link, s.name, "Nick collision with services")
+		}
+		return services
+	}
+
+	if ts <= existing.nickTS {
+		s.kill(existing, link, s.name, "Nick collision")
+	}
+	return ts < existing.nickTS
+}
+
+//Remove a client from the whole network
+func (s *Server) kill(target *Client, except *Client, killer, reason string) {
+	s.propagate(except, ":%s KILL %s :%s", killer, target.nick, reason)
+
+	target.reply(rplKill, killer, reason)
+	target.quit(fmt.Sprintf("Killed (%s (%s))", killer, reason))
+	if target.origin != nil {
+		return
+	}
+
+	//Let them see why they're going
+	deadline := time.Now().Add(linkTimeout)
+	if !target.persistent {
+		target.flush(deadline)
+		return
+	}
+	for _, conn := range target.attached {
+		conn.flush(deadline)
+	}
+}
+
+func (c *Client) setAccount(account string) {
+	c.account = account
+	if account == "" {
+		c.reply(rplLoggedOut)
+	} else {
+		c.reply(rplLoggedIn, account)
+	}
+	c.notifyPeers(rplAccountNotify, c.nick, c.accountName())
+}
+
+//Forget a server and everything behind it, quitting all their clients
+func (s *Server) removeLink(link *Link, reason string) {
+	gone := make(map[*Link]bool)
+	for key, other := range s.linkMap {
+		for l := other; l != nil; l = l.uplink {
+			if l == link {
+				gone[other] = true
+				delete(s.linkMap, key)
+				break
+			}
+		}
+	}
+
+	for _, client := range s.clientMap {
+		if client.origin != nil && gone[client.origin] {
+			client.quit(reason)
+		}
+	}
+}
+
+//Drop the link to a server. Servers not linked to us directly are dropped by
+//the server they're linked to, which is asked to in the name of whoever
+//requested it.
+func (s *Server) squit(link *Link, requester, reason string) {
+	if link.uplink == nil {
+		link.conn.reply(rplClosingLink, reason)
+		link.conn.flush(time.Now().Add(linkTimeout))
+		return
+	}
+	link.conn.send(fmt.Sprintf(":%s SQUIT %s :%s", requester, link.name, reason))
+}
+
+//Whether a linked server may pass on a KILL from source. Operators and
+//services kill users, and servers kill them to settle nick collisions.
+func (s *Server) mayKill(link *Client, source string) bool {
+	if s.linkedServer(link, source) != nil {
+		return true
+	}
+	killer := s.linkedClient(link, source)
+	return killer != nil && (killer.operator || killer.isService())
+}
+
+//Called when a link is disconnected
+func (s *Server) linkLost(c *Client) {
+	if c.peer == nil {
+		//Never finished linking
+		return
+	}
+
+	log.Printf("Lost link to %s", c.peer.name)
+
+	//The traditional netsplit quit message
+	s.removeLink(c.peer, fmt.Sprintf("%s %s", s.name, c.peer.name))
+	s.propagate(c, ":%s SQUIT %s :Connection closed", s.name, c.peer.name)
+}
+
+//Handle a line from a linked server. Lines take the same form as client
+//commands, prefixed with the nick or server name they came from.
+func (s *Server) handleLinkCommand(link *Client, line string) {
+	tags, line := parseTags(line)
+	fields := strings.Fields(line)
+	source := ""
+	if len(fields) > 0 && strings.HasPrefix(fields[0], ":") {
+		source = fields[0][1:]
+		fields = fields[1:]
+	}
+	if len(fields) < 1 {
+		return
+	}
+	command := strings.ToUpper(fields[0])
+	args := fields[1:]
+
+	if command == "ERROR" {
+		log.Printf("Link to %s closed: %s", link.linkBlock.name, strings.Join(args, " "))
+		return
+	}
+
+	if link.peer == nil {
+		//Until the link is up all we want is their SERVER line, and anything
+		//else is what they send every new connection
+		if command == "SERVER" {
+			s.acceptLink(link, args)
+		}
+		return
+	}
+
+	switch command {
+	case "SID":
+		//:uplink SID name hops [services]
+		if len(args) < 2 {
+			return
+		}
+
+		uplink := s.linkedServer(link, source)
+		hops, err := strconv.Atoi(args[1])
+		if uplink == nil || err != nil {
+			return
+		}
+
+		name := args[0]
+		if _, exists := s.linkMap[strings.ToLower(name)]; exists || strings.EqualFold(name, s.name) {
+			//The network would no longer be a tree
+			log.Printf("Dropping link to %s, %s is already linked", link.peer.name, name)
+			s.squit(link.peer, s.name, "Server "+name+" already linked")
+			return
+		}
+
+		server := &Link{name: name,
+			hops:     hops + 1,
+			uplink:   uplink,
+			conn:     link,
+			services: len(args) > 2 && args[2] == "services"}
+		s.linkMap[strings.ToLower(name)] = server
+		s.propagateLine(link, server.sid(s))
+
+	case "UID":
+		//:server UID nick ts username operator account :realname
+		if len(args) < 6 {
+			return
+		}
+
+		origin := s.linkedServer(link, source)
+		ts, err := strconv.ParseInt(args[1], 10, 64)
+		if origin == nil || err != nil {
+			return
+		}
+
+		nick := args[0]
+		if existing, exists := s.clientMap[s.casefold(nick)]; exists {
+			if !s.collide(link, existing, ts, origin.services) {
+				return
+			}
+		}
+
+		//Remote clients have no connection of their own, so replies to them
+		//go nowhere
+		client := &Client{server: s,
+			origin:     origin,
+			nick:       nick,
+			key:        s.casefold(nick),
+			nickTS:     ts,
+			username:   args[2],
+			realname:   strings.TrimPrefix(strings.Join(args[5:], " "), ":"),
+			operator:   args[3] == "1",
+			registered: true,
+			channelMap: make(map[string]*Channel)}
+		if args[4] != "*" {
+			client.account = args[4]
+		}
+		s.addClient(client)
+		s.propagateLine(link, client.uid())
+		s.monitorOnline(client)
+
+	case "NICK":
+		//:nick NICK newnick ts
+		client := s.linkedClient(link, source)
+		if client == nil || len(args) < 2 {
+			return
+		}
+
+		ts, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return
+		}
+
+		newNick := args[0]
+		if existing, exists := s.clientMap[s.casefold(newNick)]; exists && existing != client {
+			if !s.collide(link, existing, ts, client.isService()) {
+				//Make sure anyone behind us forgets them too
+				s.propagate(link, ":%s KILL %s :Nick collision", s.name, client.nick)
+				client.quit("Nick collision")
+				return
+			}
+		}
+
+		client.nickTS = ts
+		client.setNick(newNick)
+
+	case "JOIN":
+		client := s.linkedClient(link, source)
+		if client == nil || len(args) < 1 {
+			return
+		}
+
+		for _, channel := range strings.Split(args[0], ",") {
+			//Local channels are only for our own users
+			if !strings.HasPrefix(channel, "&") {
+				client.joinChannel(channel)
+			}
+		}
+
+	case "SJOIN":
+		//:server SJOIN channel ts +modes [params] :@nick +nick nick
+		if len(args) < 4 {
+			return
+		}
+		created, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return
+		}
+
+		modes := strings.TrimPrefix(args[2], "+")
+		n := strings.Count(modes, "k") + strings.Count(modes, "l")
+		if len(args) < 4+n {
+			return
+		}
+		s.linkJoin(link, source, args[0], created, parseChannelMode(modes, args[3:3+n]), args[3+n:])
+
+	case "BMASK":
+		//:server BMASK channel ts mode :mask mask
+		if len(args) < 4 {
+			return
+		}
+		created, err := strconv.ParseInt(args[1], 10, 64)
+		channel, exists := s.channelMap[s.casefold(args[0])]
+		if err != nil || !exists || created > channel.created {
+			//Lists from the newer channel don't count
+			return
+		}
+
+		modeRunes := []rune(args[2])
+		if kind, _ := s.modeType(modeRunes[0]); len(modeRunes) != 1 || kind != modeList {
+			return
+		}
+
+		var changes []modeChange
+		for _, mask := range args[3:] {
+			changes = append(changes, modeChange{true, modeRunes[0], strings.TrimPrefix(mask, ":")})
+		}
+		s.linkModes(link, source, channel, changes)
+
+	case "PART":
+		client := s.linkedClient(link, source)
+		if client == nil || len(args) < 1 {
+			return
+		}
+		client.partChannel(args[0], strings.Join(args[1:], " "))
+
+	case "PRIVMSG", "NOTICE":
+		client := s.linkedClient(link, source)
+		if client == nil || len(args) < 2 {
+			return
+		}
+		if tags["msgid"] == "" {
+			tags = nil
+		}
+		client.privmsg(command, args[0], strings.TrimPrefix(strings.Join(args[1:], " "), ":"), tags)
+
+	case "MODE":
+		client := s.linkedSource(link, source)
+		if client == nil || len(args) < 2 {
+			return
+		}
+		if channel, exists := s.channelMap[s.casefold(args[0])]; exists {
+			changes, _ := s.parseModes(args[1:])
+			client.setChannelMode(channel, changes)
+		}
+
+	case "TOPIC":
+		client := s.linkedSource(link, source)
+		if client == nil || len(args) < 1 {
+			return
+		}
+		if channel, exists := s.channelMap[s.casefold(args[0])]; exists {
+			client.setTopic(channel, strings.TrimPrefix(strings.Join(args[1:], " "), ":"))
+		}
+
+	case "TB":
+		//:server TB channel ts setter :topic, only kept if we have no topic
+		//of our own, or ours is newer
+		if len(args) < 4 {
+			return
+		}
+
+		channel, exists := s.channelMap[s.casefold(args[0])]
+		ts, err := strconv.ParseInt(args[1], 10, 64)
+		if !exists || err != nil || (channel.topic != "" && channel.topicTime <= ts) {
+			return
+		}
+
+		channel.topic = strings.TrimPrefix(strings.Join(args[3:], " "), ":")
+		channel.topicSetter = args[2]
+		channel.topicTime = ts
+		for _, client := range channel.clientMap {
+			client.reply(rplTopicChange, channel.topicSetter, channel.name, channel.topic)
+		}
+		s.propagate(link, ":%s TB %s %d %s :%s", source, channel.name, ts, channel.topicSetter, channel.topic)
+
+	case "KICK":
+		client := s.linkedSource(link, source)
+		if client == nil || len(args) < 2 {
+			return
+		}
+
+		channel, exists := s.channelMap[s.casefold(args[0])]
+		if !exists {
+			return
+		}
+		if target, inChannel := channel.clientMap[s.casefold(args[1])]; inChannel {
+			client.kick(channel, target, strings.Join(args[2:], " "))
+		}
+
+	case "QUIT":
+		client := s.linkedClient(link, source)
+		if client == nil {
+			return
+		}
+
+		reason := strings.TrimPrefix(strings.Join(args, " "), ":")
+		s.propagate(link, ":%s QUIT :%s", client.nick, reason)
+		client.quit(reason)
+
+	case "KILL":
+		//:killer KILL nick :reason
+		if len(args) < 1 || !s.mayKill(link, source) {
+			return
+		}
+
+		target, exists := s.clientMap[s.casefold(args[0])]
+		if !exists || (target.isService() && !s.fromServices(link, source)) {
+			return
+		}
+		s.kill(target, link, source, strings.TrimPrefix(strings.Join(args[1:], " "), ":"))
+
+	case "SQUIT":
+		//:server SQUIT name :reason when a server behind the link splits
+		//from its uplink, or :oper SQUIT name :reason to ask for a link to
+		//be dropped
+		if len(args) < 1 {
+			return
+		}
+
+		server, exists := s.linkMap[strings.ToLower(args[0])]
+		if !exists {
+			return
+		}
+
+		reason := strings.TrimPrefix(strings.Join(args[1:], " "), ":")
+		if server.conn == link && server.uplink != nil {
+			if s.linkedServer(link, source) == nil {
+				return
+			}
+			log.Printf("%s split from %s: %s", server.name, s.uplinkName(server), reason)
+			s.removeLink(server, fmt.Sprintf("%s %s", s.uplinkName(server), server.name))
+			s.propagate(link, ":%s SQUIT %s :%s", source, server.name, reason)
+			return
+		}
+
+		requester := s.linkedSource(link, source)
+		if requester == nil || !(requester.operator || requester.isService()) {
+			return
+		}
+
+		if server.uplink == nil {
+			//Someone asked us to drop one of our own links
+			log.Printf("SQUIT %s requested by %s", server.name, source)
+			s.squit(server, source, reason)
+		} else {
+			//Pass the request on towards the server
+			server.conn.send(fmt.Sprintf(":%s SQUIT %s :%s", source, server.name, reason))
+		}
+
+	case "OPER":
+		//:nick OPER
+		client := s.linkedClient(link, source)
+		if client == nil {
+			return
+		}
+		client.operator = true
+		s.propagate(link, ":%s OPER", client.nick)
+
+	case "SVSNICK":
+		//:services SVSNICK nick newnick
+		if len(args) < 2 || !s.fromServices(link, source) {
+			return
+		}
+
+		target, exists := s.clientMap[s.casefold(args[0])]
+		if !exists {
+			return
+		}
+
+		if target.origin != nil {
+			//Only the server the client is on can change its nick
+			target.route().send(fmt.Sprintf(":%s SVSNICK %s %s", source, target.nick, args[1]))
+			return
+		}
+
+		if s.checkNick(args[1]) != "" {
+			return
+		}
+		if existing, inUse := s.clientMap[s.casefold(args[1])]; inUse && existing != target {
+			return
+		}
+
+		target.nickTS = time.Now().Unix()
+		target.setNick(args[1])
+
+	case "ACCOUNT":
+		//:services ACCOUNT nick account, where an account of * logs them out
+		if len(args) < 2 || !s.fromServices(link, source) {
+			return
+		}
+
+		target, exists := s.clientMap[s.casefold(args[0])]
+		if !exists {
+			return
+		}
+
+		account := args[1]
+		if account == "*" {
+			account = ""
+		}
+		target.setAccount(account)
+		s.propagate(link, ":%s ACCOUNT %s %s", source, target.nick, args[1])
+
+	case "AWAY":
+		client := s.linkedClient(link, source)
+		if client == nil {
+			return
+		}
+		client.setAway(strings.TrimPrefix(strings.Join(args, " "), ":"))
+
+	case "SETNAME":
+		client := s.linkedClient(link, source)
+		if client == nil || len(args) < 1 {
+			return
+		}
+		client.setName(strings.TrimPrefix(strings.Join(args, " "), ":"))
+
+	case "INVITE":
+		//:nick INVITE target channel
+		client := s.linkedClient(link, source)
+		if client == nil || len(args) < 2 {
+			return
+		}
+
+		target, exists := s.clientMap[s.casefold(args[0])]
+		channel, chanExists := s.channelMap[s.casefold(args[1])]
+		if exists && chanExists {
+			client.invite(target, channel)
+		}
+
+	case "EOB":
+		log.Printf("Received burst from %s", source)
+	}
+}
+
+//Handle an SJOIN, adding clients behind a link to a channel, creating it if
+//need be. When both sides have the channel, the older one's modes and ops
+//win.
+func (s *Server) linkJoin(link *Client, source, channelName string, created int64, mode ChannelMode, members []string) {
+	channelKey := s.casefold(channelName)
+	channel, exists := s.channelMap[channelKey]
+	if !exists {
+		channel = s.newChannel(channelName, mode)
+		channel.created = created
+	} else if created < channel.created {
+		s.resetChannel(source, channel, mode, created)
+	} else if created == channel.created {
+		//Created at the same time, so keep the stricter of both
+		old := channel.mode
+		for _, m := range channelModes {
+			if m.kind == modeFlag && mode.hasFlag(m.mode) {
+				channel.mode.setFlag(m.mode, true)
+			}
+		}
+		if channel.mode.key == "" {
+			channel.mode.key = mode.key
+		}
+		if mode.limit > 0 && (channel.mode.limit == 0 || mode.limit < channel.mode.limit) {
+			channel.mode.limit = mode.limit
+		}
+		if channel.mode.hasFlag('H') && !old.hasFlag('H') {
+			s.setHistory(channel, s.historyLimit > 0)
+		}
+		s.announceModes(source, channel, modeDiff(old, channel.mode))
+	}
+
+	var joined []string
+	for _, member := range members {
+		member = strings.TrimPrefix(member, ":")
+		nick := strings.TrimLeft(member, "~&@%+")
+		prefix := member[:len(member)-len(nick)]
+		if created > channel.created {
+			//Ops from the newer channel don't count
+			prefix, member = "", nick
+		}
+
+		client := s.linkedClient(link, nick)
+		if client == nil {
+			continue
+		}
+		if _, inChannel := channel.clientMap[client.key]; inChannel {
+			continue
+		}
+
+		clientMode := new(ClientMode)
+		for _, char := range prefix {
+			if r, ok := s.rankForPrefix(char); ok {
+				clientMode.set(r, true)
+			}
+		}
+
+		channel.clientMap[client.key] = client
+		channel.modeMap[client.key] = clientMode
+		client.channelMap[channelKey] = channel
+
+		for _, c := range channel.clientMap {
+			client.sendJoin(c, channel)
+		}
+		s.announceModes(source, channel, rankChanges(clientMode, client.nick, true))
+		joined = append(joined, member)
+	}
+
+	if len(channel.clientMap) == 0 {
+		s.removeChannel(channel)
+		return
+	}
+
+	if len(joined) > 0 {
+		s.propagate(link, ":%s SJOIN %s %d %s :%s", source, channel.name, channel.created, channel.mode.withParams(true), strings.Join(joined, " "))
+	}
+}
+
+//Give a channel the modes of an older one it's been found to be a copy of,
+//taking away its lists and the ranks of its members
+func (s *Server) resetChannel(source string, channel *Channel, mode ChannelMode, created int64) {
+	changes := modeDiff(channel.mode, mode)
+	channel.created = created
+	channel.mode = mode
+	s.setHistory(channel, mode.hasFlag('H') && s.historyLimit > 0)
+
+	for list, entries := range channel.lists {
+		for _, entry := range entries {
+			changes = append(changes, modeChange{false, list, entry.mask})
+		}
+	}
+	channel.lists = make(map[rune][]listEntry)
+
+	for key, clientMode := range channel.modeMap {
+		changes = append(changes, rankChanges(clientMode, channel.clientMap[key].nick, false)...)
+		*clientMode = ClientMode{}
+	}
+	s.announceModes(source, channel, changes)
+}
+
+//Tell a channel's members about mode changes made by a linked server
+func (s *Server) announceModes(source string, channel *Channel, changes []modeChange) {
+	for _, line := range formatModes(changes) {
+		for _, c := range channel.clientMap {
+			c.reply(rplModeChange, source, channel.name, line)
+		}
+	}
+}
+
+//The changes giving or taking a member's ranks
+func rankChanges(clientMode *ClientMode, nick string, adding bool) []modeChange {
+	var changes []modeChange
+	for _, char := range clientMode.String() {
+		changes = append(changes, modeChange{adding, char, nick})
+	}
+	return changes
+}
+
+//Add entries from a linked server to a channel's list, passing on the ones
+//we didn't have
+func (s *Server) linkModes(link *Client, source string, channel *Channel, changes []modeChange) {
+	var added []modeChange
+	for _, change := range changes {
+		list := channel.lists[change.mode]
+		if s.checkMask(channel, change.param) != "" {
+			continue
+		}
+		if len(list) >= maxListEntries || slices.ContainsFunc(list, func(entry listEntry) bool {
+			return s.casefold(entry.mask) == s.casefold(change.param)
+		}) {
+			continue
+		}
+
+		channel.lists[change.mode] = append(list, listEntry{mask: change.param,
+			setter: source,
+			time:   time.Now().Unix()})
+		added = append(added, change)
+	}
+
+	s.announceModes(source, channel, added)
+	if len(added) > 0 {
+		s.propagate(link, ":%s BMASK %s %d %c :%s", source, channel.name, channel.created, added[0].mode, strings.Join(maskParams(added), " "))
+	}
+}
+
+//Send a linked server the entries on a channel's lists
+func (s *Server) sendLists(c *Client, channel *Channel) {
+	for list, entries := range channel.lists {
+		masks := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			masks = append(masks, entry.mask)
+		}
+		for len(masks) > 0 {
+			n := min(len(masks), sjoinBatchSize)
+			c.send(fmt.Sprintf(":%s BMASK %s %d %c :%s", s.name, channel.name, channel.created, list, strings.Join(masks[:n], " ")))
+			masks = masks[n:]
+		}
+	}
+}
+
+func maskParams(changes []modeChange) []string {
+	masks := make([]string, 0, len(changes))
+	for _, change := range changes {
+		masks = append(masks, change.param)
+	}
+	return masks
+}
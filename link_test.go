@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//How long to wait for a line before giving up on it
+const testTimeout = time.Second * 5
+
+//A server running on localhost for a test
+type testServer struct {
+	*Server
+	tlsAddr     string
+	plainAddr   string
+	fingerprint string
+}
+
+//Start a server listening on random localhost ports, with a certificate of
+//its own, shutting it down when the test ends
+func startServer(t *testing.T, name string) *testServer {
+	t.Helper()
+
+	config, err := newTLSConfig("1.2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCertificate(t)
+	config.Certificates = []tls.Certificate{cert}
+
+	s := NewServer()
+	s.name = name
+	s.tlsConfig = config
+	go s.Run()
+
+	ts := &testServer{Server: s, fingerprint: certFingerprint(cert.Certificate[0])}
+	for _, spec := range []string{"tls://127.0.0.1:0", "plain://127.0.0.1:0"} {
+		l, err := s.Listen(spec, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(spec, "tls") {
+			ts.tlsAddr = l.listener.Addr().String()
+		} else {
+			ts.plainAddr = l.listener.Addr().String()
+		}
+		go s.Serve(l)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return ts
+}
+
+//A self-signed certificate for 127.0.0.1
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+//Link two servers, each pinning the other's certificate, and wait until a
+//is linked to b
+func linkServers(t *testing.T, a, b *testServer) {
+	t.Helper()
+
+	const password = "linkpass"
+	a.linkBlocks[strings.ToLower(b.name)] = &linkBlock{name: b.name,
+		address:     b.tlsAddr,
+		password:    password,
+		fingerprint: b.fingerprint}
+	b.linkBlocks[strings.ToLower(a.name)] = &linkBlock{name: a.name,
+		address:     a.tlsAddr,
+		password:    password,
+		fingerprint: a.fingerprint}
+
+	//Watch for b showing up in LINKS
+	watcher := dialClient(t, a.plainAddr, "linkwatch")
+	go a.connectLink(a.linkBlocks[strings.ToLower(b.name)])
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		watcher.send("LINKS")
+		if line := watcher.expect(" 365 "); strings.Contains(watcher.last, b.name) || strings.Contains(line, b.name) {
+			watcher.send("QUIT")
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatalf("%s never linked to %s", a.name, b.name)
+}
+
+//A client connected to a test server
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	last string //Lines read by the last expect, before the one it wanted
+}
+
+//Connect without registering
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func dialClient(t *testing.T, addr, nick string) *testClient {
+	t.Helper()
+
+	c := dial(t, addr)
+	c.send("NICK " + nick)
+	c.send("USER " + nick + " 0 * :" + nick)
+	c.expect(" 001 ")
+	return c
+}
+
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", line); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+//Read lines until one contains want, returning it
+func (c *testClient) expect(want string) string {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	var skipped []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("waiting for %q: %s, after %q", want, err, skipped)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.Contains(line, want) {
+			c.last = strings.Join(skipped, "\n")
+			return line
+		}
+		skipped = append(skipped, line)
+	}
+}
+
+//Users and channels on each side are sent to the other when servers link
+func TestBurst(t *testing.T) {
+	a := startServer(t, "a.test")
+	b := startServer(t, "b.test")
+
+	amy := dialClient(t, a.plainAddr, "amy")
+	amy.send("JOIN #burst")
+	amy.expect(" 366 ")
+	amy.send("TOPIC #burst :from a")
+	amy.expect("TOPIC #burst")
+
+	bob := dialClient(t, b.plainAddr, "bob")
+	bob.send("JOIN #burst")
+	bob.expect(" 366 ")
+
+	linkServers(t, a, b)
+
+	bob.expect(":amy JOIN #burst")
+	amy.expect(":bob JOIN #burst")
+
+	bob.send("WHOIS amy")
+	if line := bob.expect(" 312 "); !strings.Contains(line, "amy a.test") {
+		t.Errorf("amy should be on a.test, got %q", line)
+	}
+
+	bob.send("NAMES #burst")
+	if line := bob.expect(" 353 "); !strings.Contains(line, "amy") || !strings.Contains(line, "bob") {
+		t.Errorf("both should be in #burst, got %q", line)
+	}
+
+	//Messages cross the link once it's up
+	amy.send("PRIVMSG #burst :hello from a")
+	bob.expect(":amy PRIVMSG #burst :hello from a")
+}
+
+//Bursts too big for the connection's buffers can be sent both ways at once
+//without either server waiting on the other
+func TestBurstBothWays(t *testing.T) {
+	a := startServer(t, "a.test")
+	b := startServer(t, "b.test")
+
+	//Neither event loop has anything to do until a client connects, which
+	//makes sure these are seen
+	topic := strings.Repeat("x", 300)
+	for _, s := range []*testServer{a, b} {
+		for i := 0; i < 20000; i++ {
+			name := fmt.Sprintf("#%s%d", s.name[:1], i)
+			testMember(s.Server, s.name[:1]+"user", name, rankOperator)
+			channel := s.channelMap[s.casefold(name)]
+			channel.topic, channel.topicSetter, channel.topicTime = topic, "someone", 1
+		}
+	}
+
+	linkServers(t, a, b)
+
+	//The last of b's burst makes it to a
+	amy := dialClient(t, a.plainAddr, "amy")
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		amy.send("TOPIC #b19999")
+		if line := amy.expect(" #b19999 "); strings.HasSuffix(line, topic) {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatal("b's burst never made it to a")
+}
+
+//When both sides of a link have a user with the same nick, the newer one
+//loses it
+func TestBurstNickCollision(t *testing.T) {
+	a := startServer(t, "a.test")
+	b := startServer(t, "b.test")
+
+	dialClient(t, a.plainAddr, "dup")
+	newer := dialClient(t, b.plainAddr, "dup")
+
+	linkServers(t, a, b)
+	if line := newer.expect(" KILL "); !strings.Contains(line, "Nick collision") {
+		t.Errorf("dup should have been killed for the collision, got %q", line)
+	}
+}
+
+//Users behind a server that goes away quit with the traditional netsplit
+//message, and leave their channels
+func TestNetsplit(t *testing.T) {
+	a := startServer(t, "a.test")
+	b := startServer(t, "b.test")
+
+	amy := dialClient(t, a.plainAddr, "amy")
+	amy.send("JOIN #split")
+	amy.expect(" 366 ")
+
+	linkServers(t, a, b)
+
+	bob := dialClient(t, b.plainAddr, "bob")
+	bob.send("JOIN #split")
+	amy.expect(":bob JOIN #split")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	b.Shutdown(ctx)
+
+	amy.expect(":bob QUIT :a.test b.test")
+	amy.send("NAMES #split")
+	if line := amy.expect(" 353 "); strings.Contains(line, "bob") {
+		t.Errorf("bob should have left #split, got %q", line)
+	}
+}
+
+//Users behind a link can only kill once they're operators, and no one can
+//kill in the name of someone who isn't behind the link
+func TestLinkKillNeedsOperator(t *testing.T) {
+	a := startServer(t, "a.test")
+	amy := dialClient(t, a.plainAddr, "amy")
+
+	rogue := linkFake(t, a, "rogue.test", false)
+	rogue.introduce("mallory")
+	rogue.send(":mallory KILL amy :not an operator")
+	rogue.send(":amy KILL amy :not behind the link")
+	rogue.send(":mallory OPER")
+	rogue.send(":mallory KILL amy :now an operator")
+
+	if line := amy.expect(" KILL "); !strings.HasSuffix(line, "now an operator") {
+		t.Errorf("only the operator's KILL should have worked, got %q", line)
+	}
+}
+
+//Only operators behind a link may ask for a server not behind it to be
+//dropped
+func TestLinkSquitNeedsOperator(t *testing.T) {
+	a := startServer(t, "a.test")
+	b := startServer(t, "b.test")
+	linkServers(t, a, b)
+
+	amy := dialClient(t, a.plainAddr, "amy")
+	amy.send("JOIN #split")
+	amy.expect(" 366 ")
+	bob := dialClient(t, b.plainAddr, "bob")
+	bob.send("JOIN #split")
+	amy.expect(":bob JOIN #split")
+
+	rogue := linkFake(t, a, "rogue.test", false)
+	rogue.introduce("mallory")
+	rogue.send(":rogue.test SQUIT b.test :not behind the link")
+	rogue.send(":mallory SQUIT b.test :not an operator")
+	rogue.send(":mallory PRIVMSG amy :done")
+	amy.expect(":mallory PRIVMSG amy :done")
+
+	//Links are dropped once what's queued for them has been written, so give
+	//that long enough to happen
+	time.Sleep(time.Millisecond * 200)
+	amy.send("LINKS")
+	amy.expect(" 365 ")
+	if !strings.Contains(amy.last, " 364 amy b.test ") {
+		t.Fatalf("b.test should still be linked, got %q", amy.last)
+	}
+
+	rogue.send(":mallory OPER")
+	rogue.send(":mallory SQUIT b.test :now an operator")
+	amy.expect(":bob QUIT :a.test b.test")
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+//Collects every -irc-listen flag given
+type listenerFlag []string
+
+func (f *listenerFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *listenerFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+//Listen opens the listener described by spec, which takes one of the forms:
+//
+//	tls://host:port         TLS, using the default certificate
+//	plain://127.0.0.1:port  Plaintext, restricted to loopback addresses
+//	unix:///path/to/socket  Plaintext unix domain socket
+//	wss://host:port         Websockets over HTTPS
+//	ws://127.0.0.1:port     Websockets over HTTP, restricted to loopback
+//
+//TLS listeners accept cert and key parameters to use a different certificate
+//to the default, eg. tls://:6697?cert=other.crt&key=other.key
+//
+//Plaintext listeners accept starttls=1 to offer STARTTLS, or starttls=require
+//to refuse registration until the client has used it. Only listeners that
+//require STARTTLS may use addresses other than loopback.
+//
+//Websocket listeners accept origin, a comma separated list of the origins
+//browsers may connect from, eg. wss://:8097?origin=https://chat.example.com
+//
+//TCP listeners accept proxy, a comma separated list of networks to accept
+//PROXY protocol headers from, eg. tls://:6697?proxy=10.0.0.0/8,192.0.2.1/32
+func (s *Server) Listen(spec string, tlsConfig *tls.Config) (*Listener, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+
+	l := &Listener{spec: spec}
+
+	if params.Get("cert") != "" || params.Get("key") != "" {
+		cert, err := tls.LoadX509KeyPair(params.Get("cert"), params.Get("key"))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	switch u.Scheme {
+	case "tls":
+		l.network = "tcp"
+		l.address = u.Host
+		l.tlsConfig = tlsConfig
+	case "plain":
+		l.network = "tcp"
+		l.address = u.Host
+
+		switch params.Get("starttls") {
+		case "":
+		case "1":
+			l.starttls = true
+		case "require":
+			l.starttls = true
+			l.requireTLS = true
+		default:
+			return nil, fmt.Errorf("unknown starttls option %q", params.Get("starttls"))
+		}
+		if l.starttls {
+			l.tlsConfig = tlsConfig
+		}
+
+		//Without STARTTLS being required, anything sent could be plaintext
+		l.loopbackOnly = !l.requireTLS
+		if l.loopbackOnly && !isLoopback(u.Host) {
+			return nil, fmt.Errorf("plaintext listener %q must use a loopback address", spec)
+		}
+	case "ws", "wss":
+		l.network = "tcp"
+		l.address = u.Host
+		l.websocket = true
+
+		if params.Get("origin") != "" {
+			l.origins = strings.Split(params.Get("origin"), ",")
+		}
+
+		if u.Scheme == "wss" {
+			l.tlsConfig = tlsConfig
+		} else {
+			//Only for use behind a reverse proxy that handles TLS
+			l.loopbackOnly = true
+			if !isLoopback(u.Host) {
+				return nil, fmt.Errorf("plaintext listener %q must use a loopback address", spec)
+			}
+		}
+	case "unix":
+		l.network = "unix"
+		l.address = u.Path
+
+		if l.address == "" {
+			return nil, errors.New("unix listener has no path")
+		}
+	default:
+		return nil, fmt.Errorf("unknown listener type %q", u.Scheme)
+	}
+
+	if params.Get("proxy") != "" {
+		if l.network != "tcp" {
+			return nil, fmt.Errorf("listener %q can't use the PROXY protocol", spec)
+		}
+
+		for _, cidr := range strings.Split(params.Get("proxy"), ",") {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			l.proxies = append(l.proxies, network)
+		}
+	}
+
+	l.listener, err = s.listen(l.network, l.address)
+	if err != nil {
+		return nil, err
+	}
+
+	//Clients handed over by an upgrade that came in on this listener
+	s.listenerMutex.Lock()
+	for _, client := range s.resumed[l.network+" "+l.address] {
+		client.listener = l
+	}
+	delete(s.resumed, l.network+" "+l.address)
+	s.listenerMutex.Unlock()
+
+	return l, nil
+}
+
+//Open a listener on the address given, or take over the matching listener if
+//one was handed to us by an upgrade
+func (s *Server) listen(network, address string) (net.Listener, error) {
+	s.listenerMutex.Lock()
+	listener, exists := s.inherited[network+" "+address]
+	delete(s.inherited, network+" "+address)
+	s.listenerMutex.Unlock()
+
+	if exists {
+		return listener, nil
+	}
+
+	if network == "unix" {
+		//Clear out a socket left behind by an unclean exit
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+
+	return net.Listen(network, address)
+}
+
+//Serve accepts connections on the listener until the server is shut down.
+func (s *Server) Serve(l *Listener) error {
+	s.listenerMutex.Lock()
+	if s.shuttingDown {
+		s.listenerMutex.Unlock()
+		l.listener.Close()
+		return errServerClosed
+	}
+	s.listeners = append(s.listeners, l)
+	s.listenerMutex.Unlock()
+
+	listener := l.listener
+	if len(l.proxies) > 0 {
+		listener = newProxyListener(listener, l.proxies)
+	}
+
+	if l.websocket {
+		return s.serveWebSocket(l, listener)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isShuttingDown() {
+				return errServerClosed
+			}
+			log.Printf("Error accepting connection.")
+			log.Println(err)
+			continue
+		}
+
+		if l.loopbackOnly {
+			if addr, ok := peerAddr(conn).(*net.TCPAddr); !ok || !addr.IP.IsLoopback() {
+				conn.Close()
+				continue
+			}
+		}
+
+		if l.tlsConfig != nil && !l.starttls {
+			conn = tls.Server(conn, l.tlsConfig)
+		}
+
+		s.handleConnection(conn, l)
+	}
+}
+
+//Whether host:port refers only to the loopback interface
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
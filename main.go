@@ -1,22 +1,53 @@
 package main
 
 import (
-	"crypto/tls"
 	"flag"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var (
-	tlsKeyFile  = flag.String("tls-key", "tls.key", "The private key file used for TLS")
-	tlsCertFile = flag.String("tls-cert", "tls.crt", "The certificate file used for TLS")
-	ircAddress  = flag.String("irc-address", ":6697", "The address:port to bind to and listen for clients on")
+	tlsKeyFile  = flag.String("tls-key", "tls.key", "The private key file used for TLS. May be a comma separated list, one for each certificate")
+	tlsCertFile = flag.String("tls-cert", "tls.crt", "The certificate file used for TLS. May be a comma separated list, chosen between by SNI")
+	tlsMinVer   = flag.String("tls-min-version", "1.2", "The minimum TLS version to accept, 1.2 or 1.3")
+	tlsCiphers  = flag.String("tls-ciphers", "", "Comma separated list of TLS 1.2 cipher suites to allow. Defaults to AEAD suites only")
+	tlsAutogen  = flag.Bool("tls-autogen", false, "Generate a self-signed certificate if the certificate and key files don't exist")
+	ircAddress  = flag.String("irc-address", ":6697", "The address:port to bind to and listen for clients on, if no -irc-listen is given")
 	serverName  = flag.String("irc-servername", "rosella", "Server name displayed to clients")
 	authFile    = flag.String("irc-authfile", "", "File containing usernames and passwords of operators.")
+	accountFile = flag.String("irc-accountfile", "", "File containing the accounts users may log in to with SASL.")
 	motdFile    = flag.String("irc-motdfile", "", "File container motd to display to clients.")
+	caseMapping = flag.String("irc-casemapping", "rfc1459", "How nicks and channel names are compared: ascii, rfc1459 or rfc7613 (PRECIS)")
+	unicodeName = flag.Bool("irc-unicode", false, "Allow nicks and channel names beyond ASCII. They're normalized to NFC")
+	chanTypes   = flag.String("irc-chantypes", "#", "The channel prefixes that may be used, from #&+!")
+	nickLen     = flag.Int("irc-nicklen", 30, "Longest nick allowed, in characters")
+	channelLen  = flag.Int("irc-channellen", 64, "Longest channel name allowed, in characters")
+	topicLen    = flag.Int("irc-topiclen", 390, "Longest topic allowed, in characters. Longer ones are cut short")
+	utf8Policy  = flag.String("irc-utf8", "allow", "What to do with lines from clients that aren't valid UTF-8: allow, reject or replace")
+	rankList    = flag.String("irc-ranks", rankModes, "Channel ranks that may be given, from q (owner), a (admin), o (op), h (halfop) and v (voice). Must include o")
+	linkFile    = flag.String("irc-linkfile", "", "File containing the servers this server may link with.")
+	monLimit    = flag.Int("irc-monitor-limit", 100, "Most nicks each client may watch with MONITOR, 0 to disable it")
+	histLimit   = flag.Int("irc-history-limit", 0, "Messages to keep for each channel with history enabled (+H). 0 disables history")
+	histAge     = flag.Duration("irc-history-age", time.Hour*24*7, "How long to keep history for, 0 to keep it until the limit is reached")
+	histFile    = flag.String("irc-history-file", "", "File to keep history in across restarts. History is only kept in memory if not set")
+	histSave    = flag.Duration("irc-history-save", time.Minute*5, "How often to write history to the history file, so a crash loses no more than that. 0 only writes it on shutdown")
+	histKeep    = flag.String("irc-history-keep", "", "Comma separated channels that keep their history when everyone leaves them. Others forget it")
+	shutdownMsg = flag.String("irc-shutdown-notice", "Server is shutting down", "Notice sent to clients when the server shuts down")
+	upgradeFd   = flag.Int("irc-upgrade-fd", 0, "Used internally to hand over to a new process when upgrading")
 )
 
+var listenSpecs listenerFlag
+
+func init() {
+	flag.Var(&listenSpecs, "irc-listen", "Listener to open, eg. tls://:6697, plain://127.0.0.1:6667 or unix:///run/rosella.sock. May be repeated")
+}
+
 func main() {
 
 	flag.Parse()
@@ -26,6 +57,34 @@ func main() {
 	//Init rosella itself
 	server := NewServer()
 	server.name = *serverName
+	server.shutdownNotice = *shutdownMsg
+
+	if !slices.Contains(casemappings, *caseMapping) {
+		log.Fatalf("Unknown casemapping %q", *caseMapping)
+	}
+	server.casemapping = *caseMapping
+
+	if *chanTypes == "" || strings.Trim(*chanTypes, channelPrefixes) != "" {
+		log.Fatalf("Channel prefixes must be from %q, not %q", channelPrefixes, *chanTypes)
+	}
+	if *nickLen < 1 || *channelLen < 2 || *topicLen < 1 {
+		log.Fatal("Nick, channel name and topic lengths must be positive")
+	}
+	server.unicodeNames = *unicodeName
+	server.chanTypes = *chanTypes
+	server.nickLength = *nickLen
+	server.channelLength = *channelLen
+	server.topicLength = *topicLen
+
+	if !slices.Contains(utf8Policies, *utf8Policy) {
+		log.Fatalf("Unknown UTF-8 policy %q", *utf8Policy)
+	}
+	server.utf8Policy = *utf8Policy
+
+	if !strings.ContainsRune(*rankList, 'o') || strings.Trim(*rankList, rankModes) != "" {
+		log.Fatalf("Channel ranks must be from %q and include o, not %q", rankModes, *rankList)
+	}
+	server.ranks = *rankList
 
 	if *authFile != "" {
 		log.Printf("Loading auth file: %q", *authFile)
@@ -54,6 +113,16 @@ func main() {
 		}
 	}
 
+	if *accountFile != "" {
+		log.Printf("Loading account file: %q", *accountFile)
+
+		accounts, err := loadAccounts(*accountFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.accountMap = accounts
+	}
+
 	if *motdFile != "" {
 		log.Printf("Loading motd file: %q", *motdFile)
 
@@ -71,50 +140,112 @@ func main() {
 		server.motd = string(data[:size])
 	}
 
-	tlsConfig := new(tls.Config)
+	if *linkFile != "" {
+		log.Printf("Loading link file: %q", *linkFile)
+
+		blocks, err := loadLinks(*linkFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.linkBlocks = blocks
+	}
+
+	server.monitorLimit = *monLimit
+	server.historyLimit = *histLimit
+	server.historyAge = *histAge
+	server.historyFile = *histFile
+	if *histKeep != "" {
+		server.historyKeep = strings.Split(*histKeep, ",")
+	}
 
-	tlsConfig.PreferServerCipherSuites = true
-	tlsConfig.CipherSuites = []uint16{
-		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-		tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
-		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-		tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA}
+	if server.historyLimit > 0 && server.historyFile != "" {
+		log.Printf("Loading history file: %q", server.historyFile)
 
-	cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+		if err := server.loadHistory(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	tlsConfig, err := newTLSConfig(*tlsMinVer, *tlsCiphers)
+	if err != nil {
+		log.Printf("Invalid tls configuration.")
+		log.Println(err)
+		return
+	}
+
+	tlsConfig.Certificates, err = loadCertificates(*tlsCertFile, *tlsKeyFile, *serverName, *tlsAutogen)
 	if err != nil {
 		log.Printf("Error loading tls certificate and key files.")
-		log.Printf(err.Error())
+		log.Println(err)
 		return
 	}
 
 	log.Printf("Loaded certificate and key successfully.")
+	log.Printf("Certificate fingerprint: %s", certFingerprint(tlsConfig.Certificates[0].Certificate[0]))
 
-	tlsConfig.Certificates = []tls.Certificate{cert}
+	server.tlsConfig = tlsConfig
 
-	//Fills out tlsConfig.NameToCertificate
-	tlsConfig.BuildNameToCertificate()
+	var upgradeConn *net.UnixConn
+	if *upgradeFd != 0 {
+		log.Printf("Taking over from the previous process.")
+		upgradeConn, err = server.resume(*upgradeFd)
+		if err != nil {
+			log.Printf("Could not take over from the previous process.")
+			log.Println(err)
+			return
+		}
+	}
 
-	tlsListener, err := tls.Listen("tcp", *ircAddress, tlsConfig)
-	if err != nil {
-		log.Printf("Could not open tls listener.")
-		log.Printf(err.Error())
-		return
+	if len(listenSpecs) == 0 {
+		listenSpecs = append(listenSpecs, "tls://"+*ircAddress)
+	}
+
+	var listeners []*Listener
+	for _, spec := range listenSpecs {
+		listener, err := server.Listen(spec, tlsConfig)
+		if err != nil {
+			log.Printf("Could not open listener %q.", spec)
+			log.Println(err)
+			return
+		}
+		listeners = append(listeners, listener)
 	}
 
 	go server.Run()
 
-	log.Printf("Listening on %s", *ircAddress)
+	if server.historyLimit > 0 && server.historyFile != "" && *histSave > 0 {
+		go server.autosaveHistory(*histSave)
+	}
 
-	for {
-		conn, err := tlsListener.Accept()
-		if err != nil {
-			log.Printf("Error accepting connection.")
-			log.Printf(err.Error())
-			continue
+	for _, listener := range listeners {
+		log.Printf("Listening on %s", listener.spec)
+		go server.Serve(listener)
+	}
+
+	if upgradeConn != nil {
+		server.finishResume(upgradeConn)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, os.Interrupt, syscall.SIGUSR2)
+	go func() {
+		for sig := range signalChan {
+			if sig == syscall.SIGUSR2 {
+				log.Printf("Received %s, upgrading.", sig)
+				go server.upgrade()
+				continue
+			}
+			log.Printf("Received %s, shutting down.", sig)
+			server.terminate(exitOK)
 		}
+	}()
 
-		server.HandleConnection(conn)
+	code := <-server.exitChan
+	if code == exitRestart {
+		log.Printf("Restarting.")
+		restart()
 	}
+
+	log.Printf("Exiting.")
+	os.Exit(code)
 }
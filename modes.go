@@ -0,0 +1,625 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//How a channel mode takes its parameter. The first four are the groups
+//advertised in CHANMODES.
+type modeType int
+
+const (
+	modeList    modeType = iota //A list of masks, shown when no mask is given
+	modeAlways                  //Always has a parameter
+	modeSetOnly                 //Only has a parameter when it's set
+	modeFlag                    //Never has a parameter
+	modeRank                    //Gives a member a rank, naming them
+)
+
+//Most parameters a single MODE may use, advertised as MODES
+const maxModeParams = 4
+
+//Most entries each of a channel's lists may hold
+const maxListEntries = 100
+
+//Bans starting with this quiet matching users rather than keeping them out,
+//so they may join but not talk or change nick
+const quietPrefix = "~q:"
+
+//A channel mode, other than a rank. Flags may have hooks enforcing them,
+//called only while they're set: join tells a client why it can't join, and
+//message returns what a message to the channel becomes, or false if it can't
+//be sent.
+type channelMode struct {
+	mode    rune
+	kind    modeType
+	join    func(c *Client, channel *Channel) replyCode
+	message func(c *Client, channel *Channel, command, text string) (string, bool)
+}
+
+//The channel modes, other than ranks, in the order they're advertised and
+//their hooks are called. Flags are kept by their place here, so there may be
+//at most 32 of them.
+var channelModes = []channelMode{
+	{mode: 'b', kind: modeList},
+	{mode: 'e', kind: modeList},
+	{mode: 'I', kind: modeList},
+	{mode: 'k', kind: modeAlways},
+	{mode: 'l', kind: modeSetOnly},
+	{mode: 'n', kind: modeFlag, message: noExternalMessage},
+	{mode: 'm', kind: modeFlag, message: moderatedMessage},
+	{mode: 'R', kind: modeFlag, message: registeredMessage},
+	{mode: 'T', kind: modeFlag, message: noNoticeMessage},
+	{mode: 'C', kind: modeFlag, message: noCTCPMessage},
+	{mode: 'c', kind: modeFlag, message: noColourMessage},
+	{mode: 'S', kind: modeFlag, message: stripColourMessage},
+	{mode: 'i', kind: modeFlag},
+	{mode: 'r', kind: modeFlag, join: registeredJoin},
+	{mode: 'z', kind: modeFlag, join: secureJoin},
+	{mode: 's', kind: modeFlag},
+	{mode: 't', kind: modeFlag},
+	{mode: 'H', kind: modeFlag},
+}
+
+//+n: only members may send to the channel
+func noExternalMessage(c *Client, channel *Channel, command, text string) (string, bool) {
+	_, inChannel := channel.clientMap[c.key]
+	return text, inChannel
+}
+
+//+m: only members with voice or a higher rank may talk
+func moderatedMessage(c *Client, channel *Channel, command, text string) (string, bool) {
+	return text, channel.modeMap[c.key].highest() >= rankVoice
+}
+
+//+R: only users logged in to an account, or with voice or a higher rank, may
+//talk
+func registeredMessage(c *Client, channel *Channel, command, text string) (string, bool) {
+	return text, c.account != "" || channel.modeMap[c.key].highest() >= rankVoice
+}
+
+//+T: no notices
+func noNoticeMessage(c *Client, channel *Channel, command, text string) (string, bool) {
+	return text, command != "NOTICE"
+}
+
+//+C: no CTCPs other than actions
+func noCTCPMessage(c *Client, channel *Channel, command, text string) (string, bool) {
+	return text, !strings.HasPrefix(text, "\x01") || strings.HasPrefix(text, "\x01ACTION ")
+}
+
+//+c: no colours or other formatting
+func noColourMessage(c *Client, channel *Channel, command, text string) (string, bool) {
+	return text, stripFormatting(text) == text
+}
+
+//+S: colours and other formatting are stripped
+func stripColourMessage(c *Client, channel *Channel, command, text string) (string, bool) {
+	return stripFormatting(text), true
+}
+
+//+r: only users logged in to an account may join
+func registeredJoin(c *Client, channel *Channel) replyCode {
+	if c.account == "" {
+		return errNeedReggedNick
+	}
+	return 0
+}
+
+//+z: only users connected with TLS may join
+func secureJoin(c *Client, channel *Channel) replyCode {
+	if !c.secure() {
+		return errSecureOnlyChan
+	}
+	return 0
+}
+
+//The replies listing the entries of each list mode
+var listReplies = map[rune]struct {
+	entry, end replyCode
+}{
+	'b': {rplBanList, rplEndOfBanList},
+	'e': {rplExceptList, rplEndOfExceptList},
+	'I': {rplInviteList, rplEndOfInviteList},
+}
+
+//An entry on one of a channel's lists
+type listEntry struct {
+	mask   string
+	setter string //Nick of whoever added it
+	time   int64  //When it was added, as a unix timestamp
+}
+
+//A single change made by MODE
+type modeChange struct {
+	adding bool
+	mode   rune
+	param  string
+}
+
+//How a mode takes its parameter, if it's known
+func (s *Server) modeType(mode rune) (modeType, bool) {
+	if _, isRank := s.rankForMode(mode); isRank {
+		return modeRank, true
+	}
+	for _, m := range channelModes {
+		if m.mode == mode {
+			return m.kind, true
+		}
+	}
+	return 0, false
+}
+
+//The CHANMODES token, listing the modes by how they take parameters
+func (s *Server) chanModesToken() string {
+	groups := make([]string, modeFlag+1)
+	for _, m := range channelModes {
+		if m.mode == 'H' && s.historyLimit == 0 {
+			continue
+		}
+		groups[m.kind] += string(m.mode)
+	}
+	return "CHANMODES=" + strings.Join(groups, ",")
+}
+
+//Split the arguments to MODE, after the channel, into the changes they ask
+//for. Unknown modes are returned separately. Modes past the parameter limit
+//are dropped, and list modes without a mask ask for the list.
+func (s *Server) parseModes(args []string) ([]modeChange, []rune) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	var changes []modeChange
+	var unknown []rune
+	params := args[1:]
+	used := 0
+	adding := true
+	for _, char := range args[0] {
+		switch char {
+		case '+':
+			adding = true
+			continue
+		case '-':
+			adding = false
+			continue
+		}
+
+		kind, known := s.modeType(char)
+		if !known {
+			unknown = append(unknown, char)
+			continue
+		}
+
+		if kind == modeFlag || (kind == modeSetOnly && !adding) {
+			changes = append(changes, modeChange{adding, char, ""})
+			continue
+		}
+
+		if len(params) == 0 {
+			switch {
+			case kind == modeList:
+				changes = append(changes, modeChange{adding, char, ""})
+			case kind == modeAlways && !adding:
+				//The old key isn't needed to remove it
+				changes = append(changes, modeChange{adding, char, "*"})
+			}
+			continue
+		}
+		if used == maxModeParams {
+			continue
+		}
+
+		changes = append(changes, modeChange{adding, char, strings.TrimPrefix(params[0], ":")})
+		params = params[1:]
+		used++
+	}
+	return changes, unknown
+}
+
+//Format mode changes as they're sent in MODE, eg. +ov-v nick nick nick, in
+//as many lines as the parameter limit needs
+func formatModes(changes []modeChange) []string {
+	var lines []string
+	for len(changes) > 0 {
+		var modes string
+		var params []string
+		var sign rune
+		n := 0
+		for ; n < len(changes); n++ {
+			change := changes[n]
+			if change.param != "" {
+				if len(params) == maxModeParams {
+					break
+				}
+				params = append(params, change.param)
+			}
+
+			if change.adding && sign != '+' {
+				sign = '+'
+				modes += "+"
+			} else if !change.adding && sign != '-' {
+				sign = '-'
+				modes += "-"
+			}
+			modes += string(change.mode)
+		}
+
+		lines = append(lines, strings.Join(append([]string{modes}, params...), " "))
+		changes = changes[n:]
+	}
+	return lines
+}
+
+//Apply mode changes once they've been allowed, telling the channel and
+//linked servers about the ones that made a difference
+func (c *Client) setChannelMode(channel *Channel, changes []modeChange) {
+	var applied []modeChange
+	for _, change := range changes {
+		if change, ok := c.applyMode(channel, change); ok {
+			applied = append(applied, change)
+		}
+	}
+
+	for _, line := range formatModes(applied) {
+		for _, client := range channel.clientMap {
+			client.reply(rplModeChange, c.nick, channel.name, line)
+		}
+		c.server.propagateChannel(channel, c.route(), ":%s MODE %s %s", c.nick, channel.name, line)
+	}
+}
+
+//Make a single mode change, returning it as it should be shown, and whether
+//it changed anything
+func (c *Client) applyMode(channel *Channel, change modeChange) (modeChange, bool) {
+	kind, _ := c.server.modeType(change.mode)
+	mode := &channel.mode
+
+	switch kind {
+	case modeRank:
+		key := c.server.casefold(change.param)
+		clientMode, inChannel := channel.modeMap[key]
+		r, _ := c.server.rankForMode(change.mode)
+		if !inChannel || clientMode.has(r) == change.adding {
+			return change, false
+		}
+		clientMode.set(r, change.adding)
+		change.param = channel.clientMap[key].nick
+
+	case modeList:
+		return c.setListEntry(channel, change)
+
+	case modeAlways:
+		//The key is the only one of these
+		if !change.adding {
+			if mode.key == "" {
+				return change, false
+			}
+			mode.key, change.param = "", "*"
+			break
+		}
+		if change.param == "" || change.param == mode.key || strings.ContainsAny(change.param, ",:") {
+			return change, false
+		}
+		mode.key = change.param
+
+	case modeSetOnly:
+		//The limit is the only one of these
+		if !change.adding {
+			if mode.limit == 0 {
+				return change, false
+			}
+			mode.limit = 0
+			break
+		}
+		limit, err := strconv.Atoi(change.param)
+		if err != nil || limit <= 0 || limit == mode.limit {
+			return change, false
+		}
+		mode.limit, change.param = limit, strconv.Itoa(limit)
+
+	case modeFlag:
+		if mode.hasFlag(change.mode) == change.adding {
+			return change, false
+		}
+		if change.mode == 'H' {
+			c.server.setHistory(channel, change.adding && c.server.historyLimit > 0)
+			return change, mode.hasFlag('H') == change.adding
+		}
+		mode.setFlag(change.mode, change.adding)
+	}
+	return change, true
+}
+
+//Add a mask to one of a channel's lists, or take one off it
+func (c *Client) setListEntry(channel *Channel, change modeChange) (modeChange, bool) {
+	if change.param == "" {
+		return change, false
+	}
+
+	mask := normalizeMask(change.param)
+	list := channel.lists[change.mode]
+	found := -1
+	for i, entry := range list {
+		if c.server.casefold(entry.mask) == c.server.casefold(mask) {
+			found = i
+			break
+		}
+	}
+
+	if !change.adding {
+		if found == -1 {
+			return change, false
+		}
+		change.param = list[found].mask
+		channel.lists[change.mode] = append(list[:found:found], list[found+1:]...)
+		return change, true
+	}
+
+	if found != -1 {
+		return change, false
+	}
+	if reason := c.server.checkMask(channel, mask); reason != "" {
+		c.reply(errInvalidModeParam, channel.name, string(change.mode), change.param, reason)
+		return change, false
+	}
+	if len(list) >= maxListEntries {
+		c.reply(errBanListFull, channel.name, mask, string(change.mode))
+		return change, false
+	}
+
+	channel.lists[change.mode] = append(list, listEntry{mask: mask,
+		setter: c.nick,
+		time:   time.Now().Unix()})
+	change.param = mask
+	return change, true
+}
+
+//Fill in the missing parts of a mask, so nick becomes nick!*@*
+func normalizeMask(mask string) string {
+	if strings.HasPrefix(mask, quietPrefix) {
+		return quietPrefix + normalizeMask(mask[len(quietPrefix):])
+	}
+	if _, _, _, isExtban := parseExtban(mask); isExtban {
+		return normalizeExtban(mask)
+	}
+	if !strings.ContainsAny(mask, "!@") {
+		return mask + "!*@*"
+	}
+	if !strings.Contains(mask, "!") {
+		mask = "*!" + mask
+	}
+	if !strings.Contains(mask, "@") {
+		mask += "@*"
+	}
+	return mask
+}
+
+//Whether a string matches a pattern of * and ? wildcards
+func matchWildcard(pattern, name string) bool {
+	//Where to pick up after the last *, if what follows it doesn't match
+	star, resume := -1, 0
+	p, n := 0, 0
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case p < len(pattern) && pattern[p] == '*':
+			star, resume = p, n
+			p++
+		case star != -1:
+			resume++
+			p, n = star+1, resume
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+//Whether the client matches a mask. $j extbans are only followed when follow
+//is set, so matching can't go round in circles.
+func (c *Client) matchesMask(mask string, follow bool) bool {
+	if kind, _, _, isExtban := parseExtban(mask); isExtban {
+		return (follow || kind != 'j') && c.matchesExtban(mask)
+	}
+	return c.matchesHostmask(mask)
+}
+
+//Whether the client matches a nick!user@host mask. The host is matched
+//against the client's real address, which is never shown, and may be given
+//as a CIDR range. Addresses of users on other servers aren't known, so only
+//a host of * matches them.
+func (c *Client) matchesHostmask(mask string) bool {
+	at := strings.LastIndexByte(mask, '@')
+	if at == -1 || !matchWildcard(c.server.casefold(mask[:at]), c.server.casefold(c.nick+"!"+c.username)) {
+		return false
+	}
+
+	host := mask[at+1:]
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		ip := net.ParseIP(c.address)
+		return ip != nil && network.Contains(ip)
+	}
+	return matchWildcard(strings.ToLower(host), strings.ToLower(c.address))
+}
+
+//Whether the client matches any of the entries on a list, other than quiets
+func (c *Client) matchesEntries(entries []listEntry, follow bool) bool {
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.mask, quietPrefix) && c.matchesMask(entry.mask, follow) {
+			return true
+		}
+	}
+	return false
+}
+
+//Whether the client matches an entry on one of a channel's lists, other than
+//a quiet
+func (c *Client) matchesList(channel *Channel, mode rune) bool {
+	return c.matchesEntries(channel.lists[mode], true)
+}
+
+//Whether the client is banned from a channel, and not excepted
+func (c *Client) banned(channel *Channel) bool {
+	return c.matchesList(channel, 'b') && !c.matchesList(channel, 'e')
+}
+
+//Whether the client is quieted in a channel, and not excepted
+func (c *Client) quieted(channel *Channel) bool {
+	for _, entry := range channel.lists['b'] {
+		if strings.HasPrefix(entry.mask, quietPrefix) && c.matchesMask(entry.mask[len(quietPrefix):], true) {
+			return !c.matchesList(channel, 'e')
+		}
+	}
+	return false
+}
+
+//Whether the client may not talk or change nick in a channel, because it's
+//banned or quieted there and doesn't have voice or a higher rank
+func (c *Client) muted(channel *Channel) bool {
+	if channel.modeMap[c.key].highest() >= rankVoice {
+		return false
+	}
+	return c.banned(channel) || c.quieted(channel)
+}
+
+//Send the client the entries on one of a channel's lists
+func (c *Client) sendList(channel *Channel, mode rune) {
+	replies := listReplies[mode]
+	for _, entry := range channel.lists[mode] {
+		c.reply(replies.entry, channel.name, entry.mask, entry.setter, strconv.FormatInt(entry.time, 10))
+	}
+	c.reply(replies.end, channel.name)
+}
+
+//Why the client can't join a channel, if it can't. Being invited gets past
+//everything but bans.
+func (c *Client) joinBlocked(name, key string) (replyCode, bool) {
+	channel, exists := c.server.channelMap[c.server.casefold(name)]
+	if !exists {
+		return 0, false
+	}
+	if _, inChannel := channel.clientMap[c.key]; inChannel {
+		return 0, false
+	}
+
+	if c.banned(channel) {
+		return errBannedFromChan, true
+	}
+	for i, m := range channelModes {
+		if m.join != nil && channel.mode.flags&(1<<i) != 0 {
+			if code := m.join(c, channel); code != 0 {
+				return code, true
+			}
+		}
+	}
+
+	_, invited := c.invited[c.server.casefold(channel.name)]
+	switch {
+	case invited:
+		return 0, false
+	case channel.mode.key != "" && key != channel.mode.key:
+		return errBadChannelKey, true
+	case channel.mode.limit > 0 && len(channel.clientMap) >= channel.mode.limit:
+		return errChannelIsFull, true
+	case channel.mode.hasFlag('i') && !c.matchesList(channel, 'I'):
+		return errInviteOnlyChan, true
+	}
+	return 0, false
+}
+
+//Why the client can't send a message to a channel, as the mode stopping it,
+//or the message as it should be sent. Being banned or quieted is given as b.
+func (c *Client) checkMessage(channel *Channel, command, text string) (string, rune) {
+	for i, m := range channelModes {
+		if m.message == nil || channel.mode.flags&(1<<i) == 0 {
+			continue
+		}
+		var ok bool
+		if text, ok = m.message(c, channel, command, text); !ok {
+			return "", m.mode
+		}
+	}
+	if c.muted(channel) {
+		return "", 'b'
+	}
+	return text, 0
+}
+
+func (m *ChannelMode) hasFlag(mode rune) bool {
+	for i, cm := range channelModes {
+		if cm.mode == mode && cm.kind == modeFlag {
+			return m.flags&(1<<i) != 0
+		}
+	}
+	return false
+}
+
+func (m *ChannelMode) setFlag(mode rune, on bool) {
+	for i, cm := range channelModes {
+		if cm.mode == mode && cm.kind == modeFlag {
+			if on {
+				m.flags |= 1 << i
+			} else {
+				m.flags &^= 1 << i
+			}
+		}
+	}
+}
+
+//The parameters of the modes in String, in the same order. The key is only
+//shown to members of the channel.
+func (m *ChannelMode) params(showKey bool) []string {
+	var params []string
+	if m.key != "" {
+		if showKey {
+			params = append(params, m.key)
+		} else {
+			params = append(params, "*")
+		}
+	}
+	if m.limit > 0 {
+		params = append(params, strconv.Itoa(m.limit))
+	}
+	return params
+}
+
+//The modes and their parameters, as shown in RPL_CHANNELMODEIS and sent in
+//SJOIN
+func (m *ChannelMode) withParams(showKey bool) string {
+	return strings.Join(append([]string{"+" + m.String()}, m.params(showKey)...), " ")
+}
+
+//The changes that turn one set of channel modes into another
+func modeDiff(old, new ChannelMode) []modeChange {
+	var changes []modeChange
+	for _, m := range channelModes {
+		if m.kind == modeFlag && old.hasFlag(m.mode) != new.hasFlag(m.mode) {
+			changes = append(changes, modeChange{new.hasFlag(m.mode), m.mode, ""})
+		}
+	}
+
+	if old.key != new.key {
+		if new.key == "" {
+			changes = append(changes, modeChange{false, 'k', "*"})
+		} else {
+			changes = append(changes, modeChange{true, 'k', new.key})
+		}
+	}
+	if old.limit != new.limit {
+		if new.limit == 0 {
+			changes = append(changes, modeChange{false, 'l', ""})
+		} else {
+			changes = append(changes, modeChange{true, 'l', strconv.Itoa(new.limit)})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+//Mode changes written out as eg. "+k secret, -l"
+func describeModes(changes []modeChange) string {
+	var described []string
+	for _, change := range changes {
+		sign := "-"
+		if change.adding {
+			sign = "+"
+		}
+		described = append(described, strings.TrimSpace(sign+string(change.mode)+" "+change.param))
+	}
+	return strings.Join(described, ", ")
+}
+
+func TestParseModes(t *testing.T) {
+	s := testMatchServer()
+	tests := []struct {
+		args    string
+		changes string
+		unknown string
+	}{
+		{"+nt", "+n, +t", ""},
+		{"+n-t+s", "+n, -t, +s", ""},
+		{"+k secret", "+k secret", ""},
+		{"+k", "", ""},
+		{"-k", "-k *", ""},
+		{"-k old", "-k old", ""},
+		{"+l 10", "+l 10", ""},
+		{"+l", "", ""},
+		{"-l", "-l", ""},
+		{"-l+k 10", "-l, +k 10", ""},
+		{"+b", "+b", ""},
+		{"-e", "-e", ""},
+		{"+b amy", "+b amy", ""},
+		{"+b :amy", "+b amy", ""},
+		{"+ov amy bob", "+o amy, +v bob", ""},
+		{"+o", "", ""},
+		{"+bbbbb a b c d e", "+b a, +b b, +b c, +b d", ""},
+		{"+bbbbbn a b c d e", "+b a, +b b, +b c, +b d, +n", ""},
+		{"+yn-X", "+n", "yX"},
+		{"ob amy", "+o amy, +b", ""},
+	}
+
+	for _, test := range tests {
+		changes, unknown := s.parseModes(strings.Fields(test.args))
+		if got := describeModes(changes); got != test.changes {
+			t.Errorf("%s: got changes %s, want %s", test.args, got, test.changes)
+		}
+		if string(unknown) != test.unknown {
+			t.Errorf("%s: got unknown %q, want %q", test.args, string(unknown), test.unknown)
+		}
+	}
+}
+
+func TestFormatModes(t *testing.T) {
+	tests := []struct {
+		changes []modeChange
+		lines   string
+	}{
+		{[]modeChange{{true, 'n', ""}, {true, 't', ""}}, "[+nt]"},
+		{[]modeChange{{true, 'o', "amy"}, {false, 'v', "amy"}, {true, 'v', "bob"}},
+			"[+o-v+v amy amy bob]"},
+		{[]modeChange{{false, 'k', "*"}, {false, 'l', ""}, {false, 'n', ""}}, "[-kln *]"},
+		{[]modeChange{{true, 'b', "a!*@*"}, {true, 'b', "b!*@*"}, {true, 'b', "c!*@*"},
+			{true, 'b', "d!*@*"}, {true, 'b', "e!*@*"}, {true, 'n', ""}},
+			"[+bbbb a!*@* b!*@* c!*@* d!*@* +bn e!*@*]"},
+	}
+
+	for _, test := range tests {
+		if got := fmt.Sprint(formatModes(test.changes)); got != test.lines {
+			t.Errorf("%s: got %s, want %s", describeModes(test.changes), got, test.lines)
+		}
+	}
+}
+
+func TestNormalizeMask(t *testing.T) {
+	tests := []struct {
+		mask, normal string
+	}{
+		{"amy", "amy!*@*"},
+		{"amy!user", "amy!user@*"},
+		{"user@host", "*!user@host"},
+		{"amy!user@host", "amy!user@host"},
+		{"~q:amy", "~q:amy!*@*"},
+		{"~q:$a:amy", "~q:$a:amy"},
+		{"~a:amy", "$a:amy"},
+		{"$~z", "$~z"},
+		{"~~z", "$~z"},
+	}
+
+	for _, test := range tests {
+		if got := normalizeMask(test.mask); got != test.normal {
+			t.Errorf("%s: got %s, want %s", test.mask, got, test.normal)
+		}
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"", "", true},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"amy", "amy", true},
+		{"amy", "amyb", false},
+		{"am?", "amy", true},
+		{"am?", "am", false},
+		{"a*y", "amy", true},
+		{"a*y", "ay", true},
+		{"a*y", "amyb", false},
+		{"*b*b*", "abab", true},
+		{"*ab", "aab", true},
+		{"*aab", "aaab", true},
+		{"a**?b", "acb", true},
+		{"*!*@*.example.com", "amy!user@host.example.com", true},
+		{"*!*@*.example.com", "amy!user@example.com", false},
+	}
+
+	for _, test := range tests {
+		if got := matchWildcard(test.pattern, test.name); got != test.want {
+			t.Errorf("%q against %q: got %t, want %t", test.pattern, test.name, got, test.want)
+		}
+	}
+}
+
+//Hosts are matched against the real address, by wildcard or CIDR range, and
+//nicks and usernames case insensitively
+func TestMatchesHostmask(t *testing.T) {
+	s := testMatchServer()
+	amy := testMember(s, "Amy", "#test", rankNone)
+	amy.username = "user"
+	amy.address = "192.0.2.1"
+	remote := testMember(s, "bob", "#test", rankNone)
+	remote.address = ""
+
+	tests := []struct {
+		c    *Client
+		mask string
+		want bool
+	}{
+		{amy, "amy!*@*", true},
+		{amy, "AMY!USER@*", true},
+		{amy, "amy!other@*", false},
+		{amy, "*!*@192.0.2.1", true},
+		{amy, "*!*@192.0.2.*", true},
+		{amy, "*!*@192.0.2.0/24", true},
+		{amy, "*!*@192.0.3.0/24", false},
+		{amy, "*!*@2001:db8::/32", false},
+		{amy, "*!*@host.example.com", false},
+		{amy, "amy", false},
+		{remote, "bob!*@*", true},
+		{remote, "bob!*@192.0.2.0/24", false},
+		{remote, "bob!*@?*", false},
+	}
+
+	for _, test := range tests {
+		if got := test.c.matchesHostmask(test.mask); got != test.want {
+			t.Errorf("%s against %s: got %t, want %t", test.mask, test.c.nick, got, test.want)
+		}
+	}
+}
+
+//Flags are kept as bits of a uint32, by their place in the registry
+func TestChannelModesFit(t *testing.T) {
+	flags := 0
+	seen := make(map[rune]bool)
+	for _, m := range channelModes {
+		if seen[m.mode] || strings.ContainsRune(rankModes, m.mode) {
+			t.Errorf("mode %c is registered twice", m.mode)
+		}
+		seen[m.mode] = true
+		if m.kind == modeFlag {
+			flags++
+		}
+	}
+	if flags > 32 {
+		t.Errorf("%d flags won't fit in ChannelMode", flags)
+	}
+}
+
+func TestCheckMessage(t *testing.T) {
+	s := testMatchServer()
+	amy := testMember(s, "amy", "#test", rankNone)
+	voiced := testMember(s, "voiced", "#test", rankVoice)
+	logged := testMember(s, "logged", "#test", rankNone)
+	logged.account = "logged"
+	outsider := testMember(s, "outsider", "#elsewhere", rankNone)
+	channel := s.channelMap["#test"]
+
+	tests := []struct {
+		modes   string
+		c       *Client
+		command string
+		text    string
+		sent    string
+		stopped rune
+	}{
+		{"", outsider, "PRIVMSG", "hi", "hi", 0},
+		{"n", outsider, "PRIVMSG", "hi", "", 'n'},
+		{"n", amy, "PRIVMSG", "hi", "hi", 0},
+		{"m", amy, "PRIVMSG", "hi", "", 'm'},
+		{"m", voiced, "PRIVMSG", "hi", "hi", 0},
+		{"R", amy, "PRIVMSG", "hi", "", 'R'},
+		{"R", logged, "PRIVMSG", "hi", "hi", 0},
+		{"R", voiced, "PRIVMSG", "hi", "hi", 0},
+		{"T", amy, "NOTICE", "hi", "", 'T'},
+		{"T", amy, "PRIVMSG", "hi", "hi", 0},
+		{"C", amy, "PRIVMSG", "\x01VERSION\x01", "", 'C'},
+		{"C", amy, "PRIVMSG", "\x01ACTION waves\x01", "\x01ACTION waves\x01", 0},
+		{"c", amy, "PRIVMSG", "\x0304red\x03", "", 'c'},
+		{"c", amy, "PRIVMSG", "plain", "plain", 0},
+		{"S", amy, "PRIVMSG", "\x02bold\x02 \x0304,12red\x03", "bold red", 0},
+		{"S", amy, "PRIVMSG", "\x04ff0000hex", "hex", 0},
+		{"Sc", amy, "PRIVMSG", "\x02bold", "", 'c'},
+		{"nm", outsider, "PRIVMSG", "hi", "", 'n'},
+	}
+
+	for _, test := range tests {
+		channel.mode = ChannelMode{}
+		for _, mode := range test.modes {
+			channel.mode.setFlag(mode, true)
+		}
+		sent, stopped := test.c.checkMessage(channel, test.command, test.text)
+		if sent != test.sent || stopped != test.stopped {
+			t.Errorf("+%s %s %q from %s: got %q stopped by %q", test.modes, test.command, test.text, test.c.nick, sent, stopped)
+		}
+	}
+}
+
+func TestJoinBlocked(t *testing.T) {
+	s := testMatchServer()
+	testMember(s, "founder", "#test", rankOperator)
+	channel := s.channelMap["#test"]
+	amy := testMember(s, "amy", "#elsewhere", rankNone)
+	amy.invited = make(map[string]struct{})
+
+	tests := []struct {
+		modes   string
+		account string
+		tls     bool
+		invited bool
+		code    replyCode
+	}{
+		{"", "", false, false, 0},
+		{"r", "", false, false, errNeedReggedNick},
+		{"r", "amy", false, false, 0},
+		{"r", "", false, true, errNeedReggedNick},
+		{"z", "", false, false, errSecureOnlyChan},
+		{"z", "", true, false, 0},
+		{"i", "", false, false, errInviteOnlyChan},
+		{"i", "", false, true, 0},
+		{"rz", "amy", false, false, errSecureOnlyChan},
+	}
+
+	for _, test := range tests {
+		channel.mode = ChannelMode{}
+		for _, mode := range test.modes {
+			channel.mode.setFlag(mode, true)
+		}
+		amy.account, amy.tls = test.account, test.tls
+		delete(amy.invited, "#test")
+		if test.invited {
+			amy.invited["#test"] = struct{}{}
+		}
+
+		if code, _ := amy.joinBlocked("#test", ""); code != test.code {
+			t.Errorf("+%s with account %q, TLS %t, invited %t: got %d, want %d",
+				test.modes, test.account, test.tls, test.invited, code, test.code)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Longest list of targets to put in one MONITOR reply
+const monitorLineLength = 400
+
+//Handle MONITOR, as described by the IRCv3 monitor spec
+func (c *Client) monitor(args []string) {
+	var targets []string
+	if len(args) > 1 {
+		for _, target := range strings.Split(strings.TrimPrefix(args[1], ":"), ",") {
+			if target != "" {
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	switch args[0] {
+	case "+":
+		c.monitorAdd(targets)
+	case "-":
+		for _, target := range targets {
+			c.unwatch(c.server.casefold(target))
+		}
+	case "C", "c":
+		c.monitorClear()
+	case "L", "l":
+		c.replyList(rplMonList, c.monitorNames())
+		c.reply(rplEndOfMonList)
+	case "S", "s":
+		c.monitorStatus(c.monitorNames())
+	}
+}
+
+//The nicks the client is monitoring, as it gave them
+func (c *Client) monitorNames() []string {
+	names := make([]string, 0, len(c.monitoring))
+	for _, name := range c.monitoring {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Start watching nicks, telling the client which of them are online
+func (c *Client) monitorAdd(targets []string) {
+	for i, target := range targets {
+		key := c.server.casefold(target)
+		if _, watching := c.monitoring[key]; watching {
+			continue
+		}
+
+		if len(c.monitoring) >= c.server.monitorLimit {
+			c.reply(errMonListFull, strconv.Itoa(c.server.monitorLimit), strings.Join(targets[i:], ","))
+			targets = targets[:i]
+			break
+		}
+		c.watch(key, target)
+	}
+	c.monitorStatus(targets)
+}
+
+//Tell the client which of a list of nicks are online
+func (c *Client) monitorStatus(targets []string) {
+	var online, offline []string
+	for _, target := range targets {
+		if client, exists := c.server.clientMap[c.server.casefold(target)]; exists && client.registered {
+			online = append(online, client.userhost())
+		} else {
+			offline = append(offline, target)
+		}
+	}
+	c.replyList(rplMonOnline, online)
+	c.replyList(rplMonOffline, offline)
+}
+
+func (c *Client) watch(key, name string) {
+	if c.monitoring == nil {
+		c.monitoring = make(map[string]string)
+	}
+	c.monitoring[key] = name
+
+	watchers, exists := c.server.monitorMap[key]
+	if !exists {
+		watchers = make(map[*Client]struct{})
+		c.server.monitorMap[key] = watchers
+	}
+	watchers[c] = struct{}{}
+}
+
+func (c *Client) unwatch(key string) {
+	delete(c.monitoring, key)
+
+	if watchers, exists := c.server.monitorMap[key]; exists {
+		delete(watchers, c)
+		if len(watchers) == 0 {
+			delete(c.server.monitorMap, key)
+		}
+	}
+}
+
+func (c *Client) monitorClear() {
+	for key := range c.monitoring {
+		c.unwatch(key)
+	}
+}
+
+//Send a list of nicks, split over as many replies as it takes
+func (c *Client) replyList(code replyCode, items []string) {
+	for len(items) > 0 {
+		n, length := 1, len(items[0])
+		for n < len(items) && length+1+len(items[n]) <= monitorLineLength {
+			length += 1 + len(items[n])
+			n++
+		}
+		c.reply(code, strings.Join(items[:n], ","))
+		items = items[n:]
+	}
+}
+
+//Tell everyone monitoring the client's nick that it's online
+func (s *Server) monitorOnline(client *Client) {
+	for watcher := range s.monitorMap[client.key] {
+		watcher.reply(rplMonOnline, client.userhost())
+	}
+}
+
+//Tell everyone monitoring a nick that it's gone offline
+func (s *Server) monitorOffline(nick string) {
+	for watcher := range s.monitorMap[s.casefold(nick)] {
+		watcher.reply(rplMonOffline, nick)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	nickRegexp        = regexp.MustCompile(`^[a-zA-Z\[\]_^{|}][a-zA-Z0-9\[\]_^{|}]*$`)
+	channelNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+)
+
+//The channel prefixes that may be enabled. & channels are local to the
+//server, + channels don't have modes and ! channels get a unique ID.
+const channelPrefixes = "#&+!"
+
+//Length of the ID given to ! channels
+const safeChannelIDLength = 5
+
+//Characters nicks may contain besides letters and digits
+const nickSpecials = "[]_^{|}"
+
+//Put a nick or channel name in the form it's kept in. With unicode names
+//that's NFC, so the same name can't be spelt two ways.
+func (s *Server) normalize(name string) string {
+	if s.unicodeNames {
+		return norm.NFC.String(name)
+	}
+	return name
+}
+
+//Why a nick isn't allowed, or "" if it is
+func (s *Server) checkNick(nick string) string {
+	if !utf8.ValidString(nick) {
+		return "Nicks must be valid UTF-8"
+	}
+	if nick == "" {
+		return "Nicks can't be empty"
+	}
+	if length := utf8.RuneCountInString(nick); length > s.nickLength {
+		return fmt.Sprintf("Nicks may be at most %d characters, this is %d", s.nickLength, length)
+	}
+
+	if !s.unicodeNames {
+		if !nickRegexp.MatchString(nick) {
+			return "Nicks may only contain letters, digits and " + nickSpecials + ", and can't start with a digit"
+		}
+		return ""
+	}
+
+	for i, r := range nick {
+		switch {
+		case unicode.IsLetter(r), strings.ContainsRune(nickSpecials, r):
+		case unicode.IsDigit(r), unicode.Is(unicode.M, r):
+			if i == 0 {
+				return "Nicks can't start with a digit or combining mark"
+			}
+		default:
+			return fmt.Sprintf("Nicks can't contain %q", r)
+		}
+	}
+
+	if s.casemapping == "rfc7613" {
+		if _, err := precis.UsernameCaseMapped.CompareKey(nick); err != nil {
+			return "Nick isn't allowed by PRECIS: " + err.Error()
+		}
+	}
+	return ""
+}
+
+//Why a channel name isn't allowed, or "" if it is
+func (s *Server) checkChannel(name string) string {
+	if name == "" || !strings.ContainsRune(s.chanTypes, rune(name[0])) {
+		return "Channel names must start with one of " + s.chanTypes
+	}
+	if !utf8.ValidString(name) {
+		return "Channel names must be valid UTF-8"
+	}
+	if length := utf8.RuneCountInString(name); length > s.channelLength {
+		return fmt.Sprintf("Channel names may be at most %d characters, this is %d", s.channelLength, length)
+	}
+
+	body := name[1:]
+	if body == "" {
+		return "Channel names need more than a prefix"
+	}
+
+	if !s.unicodeNames {
+		if !channelNameRegexp.MatchString(body) {
+			return "Channel names may only contain letters, digits, _ and - after the prefix"
+		}
+		return ""
+	}
+
+	for _, r := range body {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == ',' || r == ':' {
+			return fmt.Sprintf("Channel names can't contain %q", r)
+		}
+	}
+	return ""
+}
+
+//Work out which channel a JOIN is for, creating the name of a new ! channel
+//if it's asked for with !!. Returns the reason the name isn't allowed, if it
+//isn't, and whether there's no such channel.
+func (s *Server) channelToJoin(name string) (string, string, bool) {
+	if !strings.HasPrefix(name, "!") || !strings.ContainsRune(s.chanTypes, '!') {
+		return name, s.checkChannel(name), false
+	}
+
+	if strings.HasPrefix(name, "!!") {
+		//The short name is what the channel is joined by, so it has to be
+		//allowed on its own
+		if reason := s.checkChannel(name[1:]); reason != "" {
+			return name, reason, false
+		}
+		name = "!" + safeChannelID() + name[2:]
+		return name, s.checkChannel(name), false
+	}
+
+	if reason := s.checkChannel(name); reason != "" {
+		return name, reason, false
+	}
+	if _, exists := s.channelMap[s.casefold(name)]; exists {
+		return name, "", false
+	}
+
+	//Without the ID, the short name has to match a channel that exists
+	short := s.casefold(name[1:])
+	for _, channel := range s.channelMap {
+		if channel.safe() && len(channel.name) > safeChannelIDLength+1 && s.casefold(channel.name[safeChannelIDLength+1:]) == short {
+			return channel.name, "", false
+		}
+	}
+	return name, "", true
+}
+
+//A random ID for a ! channel
+func safeChannelID() string {
+	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	data := make([]byte, safeChannelIDLength)
+	rand.Read(data)
+	for i := range data {
+		data[i] = chars[int(data[i])%len(chars)]
+	}
+	return string(data)
+}
+
+//Local channels only exist on this server, and aren't shared with links
+func (ch *Channel) local() bool {
+	return strings.HasPrefix(ch.name, "&")
+}
+
+//Modeless channels have no modes, and nobody in them is an operator
+func (ch *Channel) modeless() bool {
+	return strings.HasPrefix(ch.name, "+")
+}
+
+//Safe channels have an ID after the prefix, so names can't collide
+func (ch *Channel) safe() bool {
+	return strings.HasPrefix(ch.name, "!")
+}
+
+//Send a line about a channel to linked servers, unless it's local
+func (s *Server) propagateChannel(channel *Channel, except *Client, format string, args ...interface{}) {
+	if !channel.local() {
+		s.propagate(except, format, args...)
+	}
+}
+
+//Cut a topic down to the longest allowed
+func (s *Server) truncateTopic(topic string) string {
+	if utf8.RuneCountInString(topic) <= s.topicLength {
+		return topic
+	}
+	return string([]rune(topic)[:s.topicLength])
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckNick(t *testing.T) {
+	tests := []struct {
+		unicode bool
+		nick    string
+		valid   bool
+	}{
+		{false, "amy", true},
+		{false, "[amy]_^{|}", true},
+		{false, "amy2", true},
+		{false, "2amy", false},
+		{false, "amy-pond", false},
+		{false, "amy pond", false},
+		{false, "", false},
+		{false, "ämy", false},
+		{false, strings.Repeat("a", 30), true},
+		{false, strings.Repeat("a", 31), false},
+		{true, "ämy", true},
+		{true, "αμυ", true},
+		{true, "a\u0308my", true},
+		{true, "\u0308amy", false},
+		{true, "\u0663amy", false},
+		{true, "amy\u0663", true},
+		{true, "amy!", false},
+		{true, "amy\u200b", false},
+		{true, "amy\xff", false},
+		{true, strings.Repeat("ä", 30), true},
+		{true, strings.Repeat("ä", 31), false},
+	}
+
+	for _, test := range tests {
+		s := testMatchServer()
+		s.unicodeNames = test.unicode
+		if reason := s.checkNick(test.nick); (reason == "") != test.valid {
+			t.Errorf("%q with unicode %t: got %q", test.nick, test.unicode, reason)
+		}
+	}
+}
+
+func TestCheckChannel(t *testing.T) {
+	tests := []struct {
+		unicode bool
+		name    string
+		valid   bool
+	}{
+		{false, "#amy", true},
+		{false, "&local", true},
+		{false, "+modeless", true},
+		{false, "!ABCDEsafe", false},
+		{false, "#a_b-c", true},
+		{false, "#", false},
+		{false, "amy", false},
+		{false, "", false},
+		{false, "#ämy", false},
+		{false, "#a,b", false},
+		{false, "#" + strings.Repeat("a", 63), true},
+		{false, "#" + strings.Repeat("a", 64), false},
+		{true, "#ämy", true},
+		{true, "#amy.pond", true},
+		{true, "#amy pond", false},
+		{true, "#amy\u00a0pond", false},
+		{true, "#a,b", false},
+		{true, "#a:b", false},
+		{true, "#a\x07", false},
+		{true, "#\xff", false},
+	}
+
+	for _, test := range tests {
+		s := testMatchServer()
+		s.unicodeNames = test.unicode
+		if reason := s.checkChannel(test.name); (reason == "") != test.valid {
+			t.Errorf("%q with unicode %t: got %q", test.name, test.unicode, reason)
+		}
+	}
+}
+
+func TestChannelToJoin(t *testing.T) {
+	s := testMatchServer()
+	s.chanTypes = "#!"
+	s.newChannel("!ABCDEsafe", ChannelMode{})
+
+	tests := []struct {
+		name    string
+		joined  string //"" for any new ! channel
+		valid   bool
+		missing bool
+	}{
+		{"#amy", "#amy", true, false},
+		{"!ABCDEsafe", "!ABCDEsafe", true, false},
+		{"!abcdesafe", "!abcdesafe", true, false},
+		{"!safe", "!ABCDEsafe", true, false},
+		{"!SAFE", "!ABCDEsafe", true, false},
+		{"!other", "!other", true, true},
+		{"!!new", "", true, false},
+		{"!!", "!!", false, false},
+		{"!!a b", "!!a b", false, false},
+		{"!", "!", false, false},
+	}
+
+	for _, test := range tests {
+		joined, reason, missing := s.channelToJoin(test.name)
+		if (reason == "") != test.valid || missing != test.missing {
+			t.Errorf("%s: got %q, %t", test.name, reason, missing)
+		}
+		if test.joined == "" {
+			if len(joined) != len(test.name)+safeChannelIDLength-1 || !strings.HasSuffix(joined, test.name[2:]) {
+				t.Errorf("%s: got %q, want a new ! channel", test.name, joined)
+			}
+		} else if joined != test.joined {
+			t.Errorf("%s: got %q, want %q", test.name, joined, test.joined)
+		}
+	}
+}
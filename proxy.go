@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//How long a proxy has to send the PROXY header after connecting
+const proxyHeaderTimeout = time.Second * 10
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("proxy: invalid PROXY protocol header")
+
+//A connection from a trusted proxy, which reports the address of the client
+//the proxy is relaying for. That address is used for throttling and bans,
+//and is never shown to other users.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+//Only possible if nothing sent after the header has been buffered
+func (c *proxyConn) File() (*os.File, error) {
+	f, ok := c.Conn.(filer)
+	if !ok || c.reader.Buffered() > 0 {
+		return nil, errors.New("proxy: connection can't be handed over")
+	}
+	return f.File()
+}
+
+//Wraps a listener, reading the PROXY header from connections made by
+//trusted proxies. Headers are read in the background, so a slow proxy can't
+//hold up everyone else.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyListener(listener net.Listener, trusted []*net.IPNet) *proxyListener {
+	l := &proxyListener{Listener: listener,
+		trusted: trusted,
+		conns:   make(chan net.Conn),
+		errs:    make(chan error),
+		closed:  make(chan struct{})}
+
+	go l.acceptThread()
+	return l
+}
+
+func (l *proxyListener) acceptThread() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go func() {
+			conn, err := l.readHeader(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+
+			select {
+			case l.conns <- conn:
+			case <-l.closed:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+//Connections from addresses we don't trust are treated as direct
+//connections, with no header
+func (l *proxyListener) readHeader(conn net.Conn) (net.Conn, error) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.isTrusted(addr.IP) {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	remote, err := readProxyHeader(reader)
+	if err != nil {
+		return conn, err
+	}
+	if remote == nil {
+		//The proxy is speaking for itself, eg. for a health check
+		remote = conn.RemoteAddr()
+	}
+
+	return &proxyConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+func (l *proxyListener) isTrusted(ip net.IP) bool {
+	for _, network := range l.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+//Read a version 1 or 2 PROXY header. The address returned is nil if the
+//header doesn't carry one.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(signature, proxyV2Signature) {
+		return readProxyHeaderV2(reader)
+	}
+	if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return readProxyHeaderV1(reader)
+	}
+	return nil, errProxyHeader
+}
+
+//eg. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 6697\r\n"
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	//The longest possible header is 107 bytes
+	line := make([]byte, 0, 107)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == cap(line) {
+			return nil, errProxyHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	version := header[12] >> 4
+	command := header[12] & 0x0f
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+
+	if version != 2 {
+		return nil, errProxyHeader
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	//LOCAL connections are made by the proxy itself
+	if command == 0x0 {
+		return nil, nil
+	}
+	if command != 0x1 {
+		return nil, errProxyHeader
+	}
+
+	switch family {
+	case 0x11: //TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: //TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+
+	//Other families don't carry an address we can use
+	return nil, nil
+}
+
+//The address of whatever actually connected to us, which is the proxy rather
+//than the client for proxied connections
+func peerAddr(conn net.Conn) net.Addr {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		return pc.Conn.RemoteAddr()
+	}
+	return conn.RemoteAddr()
+}
+
+type peerAddrKey struct{}
+
+//Keep track of the peer address of each websocket connection, so the handler
+//can check it
+func websocketConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, peerAddrKey{}, peerAddr(conn))
+}
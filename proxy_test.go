@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+//A version 2 header with the length given, which may not be the payload's
+func proxyV2Header(command, family byte, length int, payload []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(length))
+	return append(header, payload...)
+}
+
+//An IPv4 address block for 192.0.2.1:56324 → 192.0.2.2:6697
+var proxyV2IPv4 = []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x1a, 0x29}
+
+//An IPv6 address block for [2001:db8::1]:56324 → [2001:db8::2]:6697
+var proxyV2IPv6 = append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...),
+	0xdc, 0x04, 0x1a, 0x29)
+
+func TestReadProxyHeader(t *testing.T) {
+	longest := "PROXY UNKNOWN " + strings.Repeat("x", 107-len("PROXY UNKNOWN \r\n")) + "\r\n"
+
+	tests := []struct {
+		comment string
+		header  []byte
+		addr    string //"" for no address
+		ok      bool
+	}{
+		{"v1 IPv4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 6697\r\n"), "192.0.2.1:56324", true},
+		{"v1 IPv6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 6697\r\n"), "[2001:db8::1]:56324", true},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", true},
+		{"v1 longest", []byte(longest), "", true},
+		{"v1 too long", []byte("PROXY UNKNOWN x" + longest[len("PROXY UNKNOWN "):]), "", false},
+		{"v1 without CR", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 6697\n"), "", false},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2 192.0.2.2 56324 6697\r\n"), "", false},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 70000 6697\r\n"), "", false},
+		{"v1 missing field", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n"), "", false},
+		{"v1 unknown protocol", []byte("PROXY UDP4 192.0.2.1 192.0.2.2 56324 6697\r\n"), "", false},
+		{"not a header", []byte("NICK amy\r\nUSER amy 0 * :amy\r\n"), "", false},
+
+		{"v2 IPv4", proxyV2Header(0x1, 0x11, 12, proxyV2IPv4), "192.0.2.1:56324", true},
+		{"v2 IPv6", proxyV2Header(0x1, 0x21, 36, proxyV2IPv6), "[2001:db8::1]:56324", true},
+		{"v2 with TLVs", proxyV2Header(0x1, 0x11, 20, append(proxyV2IPv4, 1, 0, 5, 'h', 'e', 'l', 'l', 'o')), "192.0.2.1:56324", true},
+		{"v2 longest", proxyV2Header(0x1, 0x11, 65535, append(proxyV2IPv4, make([]byte, 65535-12)...)), "192.0.2.1:56324", true},
+		{"v2 local", proxyV2Header(0x0, 0x00, 0, nil), "", true},
+		{"v2 unspecified family", proxyV2Header(0x1, 0x00, 0, nil), "", true},
+		{"v2 unix family", proxyV2Header(0x1, 0x31, 216, make([]byte, 216)), "", true},
+		{"v2 IPv4 too short", proxyV2Header(0x1, 0x11, 11, proxyV2IPv4[:11]), "", false},
+		{"v2 IPv6 too short", proxyV2Header(0x1, 0x21, 35, proxyV2IPv6[:35]), "", false},
+		{"v2 truncated", proxyV2Header(0x1, 0x11, 12, proxyV2IPv4[:8]), "", false},
+		{"v2 truncated signature", proxyV2Signature[:8], "", false},
+		{"v2 bad command", proxyV2Header(0x2, 0x11, 12, proxyV2IPv4), "", false},
+	}
+
+	for _, test := range tests {
+		//Whatever the client sends after the header must be left for it, but
+		//would fill out a truncated header if sent after one
+		after := ""
+		if test.ok {
+			after = "NICK amy\r\n"
+		}
+		reader := bufio.NewReader(bytes.NewReader(append(test.header, after...)))
+		addr, err := readProxyHeader(reader)
+
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.comment, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.addr {
+			t.Errorf("%s: got address %q, want %q", test.comment, got, test.addr)
+		}
+		if rest, _ := io.ReadAll(reader); string(rest) != after {
+			t.Errorf("%s: left %q after the header", test.comment, rest)
+		}
+	}
+}
+
+//Version 2 headers with any version but 2 are refused
+func TestReadProxyHeaderV2Version(t *testing.T) {
+	header := proxyV2Header(0x1, 0x11, 12, proxyV2IPv4)
+	header[12] = 0x11
+	if _, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header))); err == nil {
+		t.Error("a version 1 binary header should be refused")
+	}
+}
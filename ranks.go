@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+)
+
+//A member's rank in a channel. Each rank may do everything the ones below it
+//can.
+type rank int
+
+const (
+	rankNone rank = iota
+	rankVoice
+	rankHalfop
+	rankOperator
+	rankAdmin
+	rankOwner
+)
+
+//The ranks that may be enabled, highest first, with the mode that gives them
+//and the prefix that shows them
+var ranks = []struct {
+	rank   rank
+	mode   rune
+	prefix rune
+}{
+	{rankOwner, 'q', '~'},
+	{rankAdmin, 'a', '&'},
+	{rankOperator, 'o', '@'},
+	{rankHalfop, 'h', '%'},
+	{rankVoice, 'v', '+'},
+}
+
+//The modes of every rank that may be enabled, as given to -irc-ranks
+const rankModes = "qaohv"
+
+func (m *ClientMode) has(r rank) bool {
+	return m != nil && m.ranks&(1<<r) != 0
+}
+
+func (m *ClientMode) set(r rank, on bool) {
+	if on {
+		m.ranks |= 1 << r
+	} else {
+		m.ranks &^= 1 << r
+	}
+}
+
+//The member's highest rank. Anyone not in the channel has no rank.
+func (m *ClientMode) highest() rank {
+	for _, r := range ranks {
+		if m.has(r.rank) {
+			return r.rank
+		}
+	}
+	return rankNone
+}
+
+//The rank given by a mode, if it's enabled
+func (s *Server) rankForMode(mode rune) (rank, bool) {
+	if strings.ContainsRune(s.ranks, mode) {
+		for _, r := range ranks {
+			if r.mode == mode {
+				return r.rank, true
+			}
+		}
+	}
+	return rankNone, false
+}
+
+//The rank shown by a prefix, if it's enabled
+func (s *Server) rankForPrefix(prefix rune) (rank, bool) {
+	for _, r := range ranks {
+		if r.prefix == prefix && strings.ContainsRune(s.ranks, r.mode) {
+			return r.rank, true
+		}
+	}
+	return rankNone, false
+}
+
+//The PREFIX token advertising the enabled ranks, eg. (ov)@+
+func (s *Server) prefixToken() string {
+	modes, prefixes := "", ""
+	for _, r := range ranks {
+		if strings.ContainsRune(s.ranks, r.mode) {
+			modes += string(r.mode)
+			prefixes += string(r.prefix)
+		}
+	}
+	return "PREFIX=(" + modes + ")" + prefixes
+}
+
+//Whether a member of the given rank may act on one of another rank, by
+//kicking them or giving or taking that rank. Halfops may only act on those
+//below them, ops and above on anyone up to their own rank.
+func outranks(own, other rank) bool {
+	if own < rankHalfop {
+		return false
+	}
+	return other < own || (other == own && own >= rankOperator)
+}
+
+//Whether the client's rank in a channel lets it make a mode change. Ranks may
+//be given or taken as far as the client outranks them and the member, and
+//other modes need ops.
+func (c *Client) maySetMode(channel *Channel, change modeChange) bool {
+	own := channel.modeMap[c.key].highest()
+	if r, isRank := c.server.rankForMode(change.mode); isRank {
+		target := channel.modeMap[c.server.casefold(change.param)].highest()
+		return outranks(own, r) && target <= own
+	}
+	return own >= rankOperator
+}
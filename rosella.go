@@ -1,6 +1,13 @@
 package main
 
-import "net"
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 const (
 	VERSION = "1.2.0"
@@ -13,20 +20,113 @@ type Server struct {
 	clientMap   map[string]*Client  //Map of nicks → clients
 	channelMap  map[string]*Channel //Map of channel names → channels
 	operatorMap map[string][]byte   //Map of usernames → bcrypt hashed passwords
+	accountMap  map[string]*account //Map of account names → accounts
+	sessionMap  map[string]*Client  //Map of account names → always-on clients
 	motd        string
+
+	connectionMap    map[*Client]struct{} //Set of all connections, registered or not
+	clientGroup      sync.WaitGroup       //Tracks running client threads
+	exitChan         chan int             //Receives the exit code once shut down
+	shutdownNotice   string               //Sent to every client on shutdown
+	shutdownDeadline time.Time            //When to give up flushing output
+	stopping         bool                 //Set by the event loop on shutdown
+	handoffState     *upgradeState        //Filled in by the event loop on handoff
+	current          *Client              //Connection whose command is being handled for its always-on client
+	labelClient      *Client              //Connection whose labeled command is being handled
+	held             []heldReply          //Replies to labelClient, held back until the command is done
+
+	listenerMutex sync.Mutex
+	listeners     []*Listener
+	inherited     map[string]net.Listener //Listeners handed over by an upgrade
+	resumed       map[string][]*Client    //Clients handed over, waiting for the listener they came in on
+	shuttingDown  bool
+	upgrading     bool
+
+	tlsConfig  *tls.Config           //Used to make outgoing links
+	linkBlocks map[string]*linkBlock //Map of server names → link file entries
+	linkMap    map[string]*Link      //Map of server names → linked servers
+
+	historyMap   map[string]*channelHistory //Map of channel names → history
+	historyLimit int                        //Most messages to keep per channel, 0 to disable
+	historyAge   time.Duration              //How long to keep messages, 0 for ever
+	historyFile  string                     //Where to keep history across restarts
+	historyKeep  []string                   //Channels that keep their history when emptied
+	batchCount   uint64
+
+	casemapping string            //How nicks and channel names are folded to keys
+	skeletonMap map[string]string //Map of nick skeletons → nicks, to catch look-alikes
+
+	unicodeNames  bool   //Allow nicks and channel names beyond ASCII
+	chanTypes     string //The channel prefixes that may be used
+	nickLength    int    //Longest nick allowed, in characters
+	channelLength int    //Longest channel name allowed, in characters
+	topicLength   int    //Longest topic kept, in characters
+	utf8Policy    string //What to do with lines that aren't valid UTF-8
+	ranks         string //Modes of the channel ranks that may be given
+
+	monitorMap   map[string]map[*Client]struct{} //Map of nicks → clients monitoring them
+	monitorLimit int                             //Most nicks a client may monitor, 0 to disable MONITOR
+}
+
+type Listener struct {
+	spec         string       //As given on the command line
+	network      string       //"tcp" or "unix"
+	address      string       //As configured, to match listeners across upgrades
+	tlsConfig    *tls.Config  //nil for plaintext listeners without STARTTLS
+	loopbackOnly bool         //Only accept connections from loopback addresses
+	starttls     bool         //Offer STARTTLS rather than TLS on connect
+	requireTLS   bool         //Refuse to register clients until they STARTTLS
+	websocket    bool         //Accept websocket connections over HTTP(S)
+	origins      []string     //Origins websocket clients may connect from
+	proxies      []*net.IPNet //Proxies trusted to send PROXY headers
+	listener     net.Listener
 }
 
 type Client struct {
-	server     *Server
-	connection net.Conn
-	signalChan chan signalCode
-	outputChan chan string
-	nick       string
-	key        string
-	registered bool
-	connected  bool
-	operator   bool
-	channelMap map[string]*Channel
+	server         *Server
+	listener       *Listener //nil if not accepted by one of our listeners
+	connection     net.Conn
+	connMutex      sync.Mutex //Guards connection, which STARTTLS replaces
+	starttlsChan   chan *tls.Config
+	starttls       *tls.Config //Set once STARTTLS is accepted, until the read thread hears
+	signalChan     chan signalCode
+	outputChan     chan string
+	flushDeadline  time.Time
+	nick           string
+	key            string
+	username       string
+	realname       string
+	address        string //For throttling and bans only, never shown to users
+	nickTS         int64  //When the nick was taken, to settle collisions
+	quitMessage    string
+	away           string //Away message, empty if not away
+	account        string //Set by SASL or services when logged in
+	saslMechanism  string //Set while authenticating
+	saslBuffer     string //The SASL response so far
+	tls            bool
+	caps           map[string]bool //Capabilities the client has enabled
+	capNegotiating bool            //Registration waits for CAP END
+	registered     bool
+	connected      bool
+	operator       bool
+	channelMap     map[string]*Channel
+	detached       bool     //Being handed over to a new process
+	resumed        bool     //Handed over from an old process
+	handoffFile    *os.File //Duplicate of the connection, once detached
+
+	origin    *Link       //The server a remote client is on, nil for ours
+	peer      *Link       //The server at the other end of a link, once linked
+	linkBlock *linkBlock  //Set on connections being used for links
+	isLink    atomic.Bool //Read by clientThread, which treats links differently
+
+	session    *Client          //The always-on client a connection is attached to
+	attached   []*Client        //Connections attached to an always-on client
+	persistent bool             //Always-on, staying connected without any connections
+	missed     []historyMessage //Messages for an always-on client with no connections
+
+	monitoring map[string]string //Map of nicks → nicks as given, watched with MONITOR
+
+	invited map[string]struct{} //Set of channels the client's been invited to
 }
 
 type eventType int
@@ -35,68 +135,85 @@ const (
 	connected eventType = iota
 	disconnected
 	command
+	shutdown
+	upgrade
+	handoff
+	save
 )
 
 type Event struct {
 	client *Client
 	input  string
 	event  eventType
+	done   chan struct{} //Closed once the event has been handled, if set
 }
 
 type Channel struct {
-	name      string
-	topic     string
-	clientMap map[string]*Client
-	mode      ChannelMode
-	modeMap   map[string]*ClientMode
+	name        string
+	topic       string
+	topicSetter string //Nick of whoever set the topic
+	topicTime   int64  //When the topic was set, as a unix timestamp
+	created     int64  //When the channel was created, as a unix timestamp
+	clientMap   map[string]*Client
+	mode        ChannelMode
+	modeMap     map[string]*ClientMode
+	lists       map[rune][]listEntry //Map of list modes → their entries
 }
 
 type ChannelMode struct {
-	secret      bool //Channel is hidden from LIST
-	topicLocked bool //Only ops may change topic
-	moderated   bool //Only ops and voiced may speak
-	noExternal  bool //Only users in the channel may talk to it
+	flags uint32 //Bit set of the flag modes that are set, by their place in channelModes
+
+	key   string //Needed to join, if set
+	limit int    //Most members the channel may have, if set
 }
 
 func (m *ChannelMode) String() string {
 	modeStr := ""
-	if m.secret {
-		modeStr += "s"
+	for _, cm := range channelModes {
+		if cm.kind == modeFlag && m.hasFlag(cm.mode) {
+			modeStr += string(cm.mode)
+		}
 	}
-	if m.topicLocked {
-		modeStr += "t"
+	if m.key != "" {
+		modeStr += "k"
 	}
-	if m.moderated {
-		modeStr += "m"
-	}
-	if m.noExternal {
-		modeStr += "n"
+	if m.limit > 0 {
+		modeStr += "l"
 	}
 	return modeStr
 }
 
 type ClientMode struct {
-	operator bool //Channel operator
-	voice    bool //Has voice
+	ranks uint8 //Bit set of the ranks the member has
 }
 
+//The prefix of the member's highest rank
 func (m *ClientMode) Prefix() string {
-	if m.operator {
-		return "@"
-	} else if m.voice {
-		return "+"
-	} else {
-		return ""
+	for _, r := range ranks {
+		if m.has(r.rank) {
+			return string(r.prefix)
+		}
 	}
+	return ""
+}
+
+//Every prefix the client has, highest first, for clients with multi-prefix
+func (m *ClientMode) Prefixes() string {
+	prefixes := ""
+	for _, r := range ranks {
+		if m.has(r.rank) {
+			prefixes += string(r.prefix)
+		}
+	}
+	return prefixes
 }
 
 func (m *ClientMode) String() string {
 	modeStr := ""
-	if m.operator {
-		modeStr += "o"
-	}
-	if m.voice {
-		modeStr += "v"
+	for _, r := range ranks {
+		if m.has(r.rank) {
+			modeStr += string(r.mode)
+		}
 	}
 	return modeStr
 }
@@ -104,26 +221,61 @@ func (m *ClientMode) String() string {
 type signalCode int
 
 const (
-	signalStop signalCode = iota
+	signalStop   signalCode = iota
+	signalFlush             //Write any queued output, then stop
+	signalDetach            //Stop reading, write queued output, then stop
 )
 
 type replyCode int
 
 const (
 	rplWelcome replyCode = iota
+	rplISupport
 	rplJoin
 	rplPart
 	rplTopic
 	rplNoTopic
+	rplTopicWhoTime
+	rplTopicChange
 	rplNames
 	rplEndOfNames
+	rplWhoReply
+	rplEndOfWho
+	rplWhoisUser
+	rplWhoisServer
+	rplWhoisOperator
+	rplWhoisAccount
+	rplWhoisChannels
+	rplEndOfWhois
+	rplAway
+	rplUnAway
+	rplNowAway
+	rplAwayNotify
+	rplAccountNotify
+	rplSetName
+	rplInvite
+	rplInviteNotify
+	rplInviting
+	rplMonOnline
+	rplMonOffline
+	rplMonList
+	rplEndOfMonList
 	rplNickChange
 	rplKill
 	rplMsg
+	rplNoticeMsg
 	rplList
 	rplListEnd
 	rplOper
 	rplChannelModeIs
+	rplCreationTime
+	rplModeChange
+	rplBanList
+	rplEndOfBanList
+	rplExceptList
+	rplEndOfExceptList
+	rplInviteList
+	rplEndOfInviteList
 	rplKick
 	rplInfo
 	rplVersion
@@ -131,15 +283,56 @@ const (
 	rplMOTD
 	rplEndOfMOTD
 	rplPong
+	rplNotice
+	rplCap
+	rplStartTLS
+	rplClosingLink
+	rplQuit
+	rplLinks
+	rplEndOfLinks
+	rplLoggedIn
+	rplLoggedOut
+	rplBatchStart
+	rplBatchEnd
+	rplHistoryTarget
+	rplFail
+	rplAck
+	rplAuthenticate
+	rplSASLSuccess
+	rplSASLMechs
 	errMoreArgs
 	errNoNick
 	errInvalidNick
 	errNickInUse
 	errAlreadyReg
 	errNoSuchNick
+	errNoSuchServer
+	errNoSuchChannel
+	errNoChanModes
+	errBadChanName
+	errNotOnChannel
+	errUserOnChannel
 	errUnknownCommand
 	errNotReg
 	errPassword
 	errNoPriv
+	errChanOPrivsNeeded
+	errUnknownMode
+	errInvalidModeParam
+	errChannelIsFull
+	errInviteOnlyChan
+	errBannedFromChan
+	errBadChannelKey
+	errBanListFull
+	errBanOnChan
+	errNeedReggedNick
+	errSecureOnlyChan
 	errCannotSend
+	errInvalidCapCmd
+	errStartTLS
+	errTLSRequired
+	errSASLFail
+	errSASLAborted
+	errSASLAlready
+	errMonListFull
 )
@@ -1,26 +1,40 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net"
-	"regexp"
+	"strconv"
 	"strings"
-)
-
-var (
-	nickRegexp    = regexp.MustCompile(`^[a-zA-Z\[\]_^{|}][a-zA-Z0-9\[\]_^{|}]*$`)
-	channelRegexp = regexp.MustCompile(`^#[a-zA-Z0-9_\-]+$`)
+	"time"
 )
 
 func NewServer() *Server {
 	return &Server{eventChan: make(chan Event),
-		name:        "rosella",
-		clientMap:   make(map[string]*Client),
-		channelMap:  make(map[string]*Channel),
-		operatorMap: make(map[string][]byte),
-		motd:        "Welcome to IRC. Powered by Rosella."}
+		name:           "rosella",
+		clientMap:      make(map[string]*Client),
+		channelMap:     make(map[string]*Channel),
+		operatorMap:    make(map[string][]byte),
+		accountMap:     make(map[string]*account),
+		sessionMap:     make(map[string]*Client),
+		monitorMap:     make(map[string]map[*Client]struct{}),
+		connectionMap:  make(map[*Client]struct{}),
+		linkBlocks:     make(map[string]*linkBlock),
+		skeletonMap:    make(map[string]string),
+		casemapping:    "rfc1459",
+		utf8Policy:     "allow",
+		ranks:          rankModes,
+		chanTypes:      "#",
+		nickLength:     30,
+		channelLength:  64,
+		topicLength:    390,
+		linkMap:        make(map[string]*Link),
+		historyMap:     make(map[string]*channelHistory),
+		exitChan:       make(chan int, 1),
+		shutdownNotice: "Server is shutting down",
+		motd:           "Welcome to IRC. Powered by Rosella."}
 }
 
 func (s *Server) Run() {
@@ -30,17 +44,51 @@ func (s *Server) Run() {
 }
 
 func (s *Server) HandleConnection(conn net.Conn) {
-	client := &Client{server: s,
-		connection: conn,
-		outputChan: make(chan string),
-		signalChan: make(chan signalCode, 3),
-		channelMap: make(map[string]*Channel),
-		connected:  true}
+	s.handleConnection(conn, nil)
+}
+
+func (s *Server) handleConnection(conn net.Conn, listener *Listener) {
+	client := s.newClient(conn)
+	client.listener = listener
+
+	if listener != nil && listener.websocket && listener.tlsConfig != nil {
+		//Websocket connections are wrapped, so newClient can't tell
+		client.tls = true
+	}
 
+	if !s.addClientThread() {
+		conn.Close()
+		return
+	}
 	go client.clientThread()
 }
 
+func (s *Server) newClient(conn net.Conn) *Client {
+	_, isTLS := conn.(*tls.Conn)
+
+	//Proxied connections report the real client's address
+	address := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+
+	return &Client{server: s,
+		address:      address,
+		connection:   conn,
+		outputChan:   make(chan string),
+		signalChan:   make(chan signalCode, 3),
+		starttlsChan: make(chan *tls.Config, 1),
+		channelMap:   make(map[string]*Channel),
+		caps:         make(map[string]bool),
+		tls:          isTLS,
+		connected:    true}
+}
+
 func (s *Server) handleEvent(e Event) {
+	if e.done != nil {
+		defer close(e.done)
+	}
+
 	defer func(event Event) {
 		err := recover()
 		if err != nil {
@@ -52,6 +100,26 @@ func (s *Server) handleEvent(e Event) {
 	switch e.event {
 	case connected:
 		//Client connected
+		s.connectionMap[e.client] = struct{}{}
+
+		if s.stopping {
+			//Accepted just before we stopped listening
+			e.client.reply(rplClosingLink, s.shutdownNotice)
+			e.client.flush(s.shutdownDeadline)
+			return
+		}
+
+		if e.client.linkBlock != nil {
+			//We're connecting to another server
+			e.client.send(fmt.Sprintf("SERVER %s %s", s.name, e.client.linkBlock.password))
+			return
+		}
+
+		if e.client.resumed {
+			e.client.reply(rplNotice, fmt.Sprintf("Server upgraded to Rosella v%s", VERSION))
+			return
+		}
+
 		e.client.reply(rplMOTDStart)
 		motd := s.motd
 		for len(motd) > 80 {
@@ -64,25 +132,165 @@ func (s *Server) handleEvent(e Event) {
 		e.client.reply(rplEndOfMOTD)
 	case disconnected:
 		//Client disconnected
+		if e.client.detached {
+			//Still needed for the handoff
+			return
+		}
+
+		if session := e.client.session; session != nil {
+			//The always-on client stays, even if this was its last connection
+			session.release(e.client)
+			delete(s.connectionMap, e.client)
+			return
+		}
+
+		if e.client.linkBlock != nil {
+			s.linkLost(e.client)
+		}
+
+		reason := e.client.quitMessage
+		if reason == "" {
+			reason = "Disconnecting"
+		}
+
+		//Killed clients have already been removed
+		if e.client.registered && s.clientMap[e.client.key] == e.client {
+			s.propagate(nil, ":%s QUIT :%s", e.client.nick, reason)
+		}
+		e.client.quit(reason)
+
+		delete(s.connectionMap, e.client)
+	case shutdown:
+		//Server is going down, tell everyone why
+		s.stopping = true
+		s.persist()
+
+		for client := range s.connectionMap {
+			if client.connected {
+				client.reply(rplNotice, s.shutdownNotice)
+				client.reply(rplClosingLink, s.shutdownNotice)
+				client.flush(s.shutdownDeadline)
+			}
+		}
+	case upgrade:
+		s.detachClients()
+	case save:
+		s.persist()
+	case handoff:
+		//In case the new process fails and we have to restart instead
+		s.persist()
+		s.handoffState = s.snapshot()
 	case command:
-		//Client send a command
-		fields := strings.Fields(e.input)
-		if len(fields) < 1 {
+		if commandName(e.input) == "STARTTLS" {
+			//The client's read thread is waiting to hear whether to switch to
+			//TLS, however far the command gets
+			defer func() {
+				e.client.starttlsChan <- e.client.starttls
+				e.client.starttls = nil
+			}()
+		}
+
+		if e.client.linkBlock != nil {
+			s.handleLinkCommand(e.client, e.input)
+			return
+		}
+
+		input, ok := s.checkUTF8(e.input)
+		if !ok {
+			command := strings.ToValidUTF8(commandName(e.input), "")
+			if command == "" {
+				command = "*"
+			}
+			e.client.reply(rplFail, command, "INVALID_UTF8", "Message rejected, it isn't valid UTF-8")
 			return
 		}
 
-		if strings.HasPrefix(fields[0], ":") {
+		//Client send a command
+		tags, line := parseTags(input)
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], ":") {
 			fields = fields[1:]
 		}
+		if len(fields) < 1 {
+			return
+		}
 		command := strings.ToUpper(fields[0])
 		args := fields[1:]
 
-		s.handleCommand(e.client, command, args)
+		//STARTTLS has to be answered before the handshake starts
+		if label := tags["label"]; label != "" && e.client.caps["labeled-response"] && command != "STARTTLS" {
+			s.labelClient = e.client
+			defer s.sendLabeled(e.client, label)
+		}
+
+		client := e.client
+		if client.session != nil && !connectionCommand(command) {
+			//Connections act as the always-on client they're attached to
+			s.current = client
+			client = client.session
+			defer func() {
+				s.current = nil
+			}()
+		}
+
+		s.handleCommand(client, command, args)
+	}
+}
+
+//Create a channel. Channels that had history when they were last emptied get
+//it back, along with when they were first created.
+func (s *Server) newChannel(name string, mode ChannelMode) *Channel {
+	channel := &Channel{name: name,
+		created:   time.Now().Unix(),
+		clientMap: make(map[string]*Client),
+		modeMap:   make(map[string]*ClientMode),
+		lists:     make(map[rune][]listEntry),
+		mode:      mode}
+	s.channelMap[s.casefold(name)] = channel
+
+	if history, exists := s.historyMap[s.casefold(name)]; exists && history.Created != 0 {
+		channel.created = history.Created
+	}
+	if _, exists := s.historyMap[s.casefold(name)]; exists || mode.hasFlag('H') {
+		s.setHistory(channel, s.historyLimit > 0)
+	}
+	return channel
+}
+
+//Forget a channel once everyone has left it, along with its history unless
+//it's one that keeps it
+func (s *Server) removeChannel(channel *Channel) {
+	key := s.casefold(channel.name)
+	delete(s.channelMap, key)
+	if !s.keepsHistory(channel.name) {
+		delete(s.historyMap, key)
 	}
 }
 
+//The command name from a line sent by a client, in upper case
+func commandName(line string) string {
+	_, line = parseTags(line)
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], ":") {
+		fields = fields[1:]
+	}
+	if len(fields) < 1 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
 func (s *Server) handleCommand(client *Client, command string, args []string) {
 
+	if client.listener != nil && client.listener.requireTLS && !client.tls {
+		switch command {
+		case "CAP", "STARTTLS", "PING", "QUIT":
+		default:
+			client.reply(errTLSRequired)
+			return
+		}
+	}
+
 	switch command {
 	case "PING":
 		client.reply(rplPong)
@@ -96,36 +304,142 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		newNick := args[0]
+		newNick := s.normalize(args[0])
+
+		//Check newNick is allowed, telling them why if it isn't
+		if reason := s.checkNick(newNick); reason != "" {
+			client.reply(errInvalidNick, args[0], reason)
+			return
+		}
+
+		//Users who are banned or quieted in a channel can't dodge it by
+		//changing nick
+		for _, channel := range client.channelMap {
+			if client.muted(channel) {
+				client.reply(errBanOnChan, newNick, channel.name)
+				return
+			}
+		}
+
+		if existing, exists := s.clientMap[s.casefold(newNick)]; exists {
+			//Clients may log in to the always-on client holding the nick
+			//after asking for it, so that's settled when they register
+			mayOwn := client.capNegotiating || client.ownsSession(existing)
+			if client.registered || !existing.persistent || !mayOwn {
+				client.reply(errNickInUse, newNick)
+				return
+			}
 
-		//Check newNick is of valid formatting (regex)
-		if nickRegexp.MatchString(newNick) == false {
-			client.reply(errInvalidNick, newNick)
+			s.removeClient(client)
+			client.nick, client.key = existing.nick, existing.key
+			client.register()
 			return
 		}
 
-		if _, exists := s.clientMap[strings.ToLower(newNick)]; exists {
+		//Protect other users from impersonation
+		if s.confusable(newNick) {
 			client.reply(errNickInUse, newNick)
 			return
 		}
 
-		//Protect the server name from being used
-		if strings.ToLower(newNick) == strings.ToLower(s.name) {
+		//Protect the server names from being used
+		if _, linked := s.linkMap[strings.ToLower(newNick)]; linked || strings.ToLower(newNick) == strings.ToLower(s.name) {
 			client.reply(errNickInUse, newNick)
 			return
 		}
 
+		client.nickTS = time.Now().Unix()
 		client.setNick(newNick)
+		client.register()
 
 	case "USER":
-		if client.nick == "" {
-			client.reply(rplKill, "Your nickname is already being used", "")
-			client.disconnect()
-		} else {
-			client.reply(rplWelcome)
-			client.registered = true
+		if client.registered {
+			client.reply(errAlreadyReg)
+			return
+		}
+
+		if len(args) < 4 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		client.username = args[0]
+		client.realname = strings.TrimPrefix(strings.Join(args[3:], " "), ":")
+		client.register()
+
+	case "SERVER":
+		if client.registered {
+			client.reply(errAlreadyReg)
+			return
+		}
+
+		s.acceptLink(client, args)
+
+	case "CAP":
+		if len(args) < 1 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "LS":
+			if !client.registered {
+				client.capNegotiating = true
+			}
+			client.reply(rplCap, "LS", client.availableCaps())
+		case "LIST":
+			client.reply(rplCap, "LIST", client.enabledCaps())
+		case "REQ":
+			if !client.registered {
+				client.capNegotiating = true
+			}
+			request := strings.TrimPrefix(strings.Join(args[1:], " "), ":")
+			if client.requestCaps(request) {
+				client.reply(rplCap, "ACK", request)
+			} else {
+				client.reply(rplCap, "NAK", request)
+			}
+		case "END":
+			client.capNegotiating = false
+			client.register()
+		default:
+			client.reply(errInvalidCapCmd, args[0])
+		}
+
+	case "AUTHENTICATE":
+		if client.registered {
+			client.reply(errSASLAlready)
+			return
+		}
+
+		if len(args) < 1 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		client.authenticate(args[0])
+
+	case "STARTTLS":
+		if client.listener == nil || !client.listener.starttls {
+			client.reply(errStartTLS, "STARTTLS is not supported on this port")
+			return
 		}
 
+		if client.tls {
+			client.reply(errStartTLS, "Already using TLS")
+			return
+		}
+
+		if client.registered {
+			client.reply(errStartTLS, "STARTTLS must be used before registering")
+			return
+		}
+
+		client.reply(rplStartTLS)
+		client.tls = true
+		delete(client.caps, "tls")
+		client.starttls = client.listener.tlsConfig
+
 	case "JOIN":
 		if client.registered == false {
 			client.reply(errNotReg)
@@ -145,11 +459,29 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		channels := strings.Split(args[0], ",")
-		for _, channel := range channels {
-			//Join the channel if it's valid
-			if channelRegexp.MatchString(channel) {
-				client.joinChannel(channel)
+		//Keys are given in the same order as the channels
+		var keys []string
+		if len(args) > 1 {
+			keys = strings.Split(args[1], ",")
+		}
+
+		channels := strings.Split(s.normalize(args[0]), ",")
+		for i, channel := range channels {
+			key := ""
+			if i < len(keys) {
+				key = keys[i]
+			}
+
+			//Join the channel if it's valid and they're let in
+			name, reason, missing := s.channelToJoin(channel)
+			if reason != "" {
+				client.reply(errBadChanName, channel, reason)
+			} else if missing {
+				client.reply(errNoSuchChannel, channel)
+			} else if code, blocked := client.joinBlocked(name, key); blocked {
+				client.reply(code, name)
+			} else {
+				client.joinChannel(name)
 			}
 		}
 
@@ -166,55 +498,55 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 
 		reason := strings.Join(args[1:], " ")
 
-		channels := strings.Split(args[0], ",")
+		channels := strings.Split(s.normalize(args[0]), ",")
 		for _, channel := range channels {
-			//Part the channel if it's valid
-			if channelRegexp.MatchString(channel) {
-				client.partChannel(channel, reason)
+			client.partChannel(channel, reason)
+		}
+
+	case "PRIVMSG", "NOTICE":
+		//Notices never get errors back, so bots can't be made to loop
+		notice := command == "NOTICE"
+		fail := func(code replyCode, args ...string) {
+			if !notice {
+				client.reply(code, args...)
 			}
 		}
 
-	case "PRIVMSG":
 		if client.registered == false {
-			client.reply(errNotReg)
+			fail(errNotReg)
 			return
 		}
 
 		if len(args) < 2 {
-			client.reply(errMoreArgs)
+			fail(errMoreArgs)
 			return
 		}
 
-		message := strings.Join(args[1:], " ")
+		message := strings.TrimPrefix(strings.Join(args[1:], " "), ":")
 
-		channel, chanExists := s.channelMap[strings.ToLower(args[0])]
-		client2, clientExists := s.clientMap[strings.ToLower(args[0])]
+		channel, chanExists := s.channelMap[s.casefold(args[0])]
+		target, clientExists := s.clientMap[s.casefold(args[0])]
 
 		if chanExists {
-			if channel.mode.noExternal {
-				if _, inChannel := channel.clientMap[client.key]; !inChannel {
-					//Not in channel, not allowed to send
-					client.reply(errCannotSend, args[0])
-					return
-				}
-			}
-			if channel.mode.moderated {
-				clientMode := channel.modeMap[client.key]
-				if !clientMode.operator && !clientMode.voice {
-					//It's moderated and we're not +v or +o, do nothing
-					client.reply(errCannotSend, args[0])
-					return
-				}
-			}
-			for _, c := range channel.clientMap {
-				if c != client {
-					c.reply(rplMsg, client.nick, args[0], message)
-				}
+			//The channel's modes may stop the message, or change it
+			var blocked rune
+			if message, blocked = client.checkMessage(channel, command, message); blocked != 0 {
+				fail(errCannotSend, args[0], string(blocked))
+				return
 			}
-		} else if clientExists {
-			client2.reply(rplMsg, client.nick, client2.nick, message)
-		} else {
-			client.reply(errNoSuchNick, args[0])
+		} else if !clientExists {
+			fail(errNoSuchNick, args[0])
+			return
+		}
+
+		//Relayed messages have to fit in a line along with who they're from
+		//and to, so long ones are sent in parts
+		parts := splitMessage(message, maxReplyLength-len(fmt.Sprintf(":%s %s %s :", client.nick, command, args[0])))
+		for _, part := range parts {
+			client.privmsg(command, args[0], part, nil)
+		}
+		if !notice && !chanExists && target.away != "" {
+			client.reply(rplAway, target.nick, target.away)
 		}
 
 	case "QUIT":
@@ -223,6 +555,7 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
+		client.quitMessage = strings.TrimPrefix(strings.Join(args, " "), ":")
 		client.disconnect()
 
 	case "TOPIC":
@@ -236,37 +569,176 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		channel, exists := s.channelMap[strings.ToLower(args[0])]
+		channel, exists := s.channelMap[s.casefold(args[0])]
 		if exists == false {
 			client.reply(errNoSuchNick, args[0])
 			return
 		}
 
 		if len(args) == 1 {
-			client.reply(rplTopic, channel.name, channel.topic)
+			client.sendTopic(channel)
 			return
 		}
 
-		clientMode := channel.modeMap[client.key]
-		if channel.mode.topicLocked && !clientMode.operator {
-			client.reply(errNoPriv)
+		if channel.mode.hasFlag('t') && channel.modeMap[client.key].highest() < rankHalfop {
+			client.reply(errChanOPrivsNeeded, channel.name)
 			return
 		}
 
 		if args[1] == ":" {
-			channel.topic = ""
-			for _, client := range channel.clientMap {
-				client.reply(rplNoTopic, channel.name)
-			}
+			client.setTopic(channel, "")
 		} else {
 			topic := strings.Join(args[1:], " ")
 			topic = strings.TrimPrefix(topic, ":")
-			channel.topic = topic
+			client.setTopic(channel, s.truncateTopic(stripControls(topic)))
+		}
+
+	case "AWAY":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		client.setAway(strings.TrimPrefix(strings.Join(args, " "), ":"))
+
+	case "SETNAME":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		realname := strings.TrimPrefix(strings.Join(args, " "), ":")
+		if realname == "" {
+			client.reply(rplFail, "SETNAME", "INVALID_REALNAME", "*", "Realname is not valid")
+			return
+		}
+
+		client.setName(realname)
+
+	case "WHOIS":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		if len(args) < 1 {
+			client.reply(errNoNick)
+			return
+		}
 
-			for _, client := range channel.clientMap {
-				client.reply(rplTopic, channel.name, channel.topic)
+		//The nick is last, after the server if one is given
+		nick := args[len(args)-1]
+		target, exists := s.clientMap[s.casefold(nick)]
+		if !exists {
+			client.reply(errNoSuchNick, nick)
+			client.reply(rplEndOfWhois, nick)
+			return
+		}
+
+		client.sendWhois(target)
+
+	case "INVITE":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		if len(args) < 2 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		target, exists := s.clientMap[s.casefold(args[0])]
+		if !exists {
+			client.reply(errNoSuchNick, args[0])
+			return
+		}
+
+		channel, exists := s.channelMap[s.casefold(args[1])]
+		if !exists {
+			client.reply(errNoSuchNick, args[1])
+			return
+		}
+
+		if _, inChannel := channel.clientMap[client.key]; !inChannel {
+			client.reply(errNotOnChannel, channel.name)
+			return
+		}
+
+		if _, inChannel := channel.clientMap[target.key]; inChannel {
+			client.reply(errUserOnChannel, target.nick, channel.name)
+			return
+		}
+
+		if channel.mode.hasFlag('i') && channel.modeMap[client.key].highest() < rankHalfop {
+			client.reply(errChanOPrivsNeeded, channel.name)
+			return
+		}
+
+		client.reply(rplInviting, target.nick, channel.name)
+		client.invite(target, channel)
+
+	case "MONITOR":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		if s.monitorLimit == 0 {
+			client.reply(errUnknownCommand, command)
+			return
+		}
+
+		if len(args) < 1 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		client.monitor(args)
+
+	case "NAMES":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		if len(args) < 1 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		for _, channelName := range strings.Split(args[0], ",") {
+			if channel, exists := s.channelMap[s.casefold(channelName)]; exists {
+				if _, inChannel := channel.clientMap[client.key]; inChannel || !channel.mode.hasFlag('s') {
+					client.sendNames(channel)
+					continue
+				}
+			}
+			client.reply(rplEndOfNames, channelName)
+		}
+
+	case "WHO":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		if len(args) < 1 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		mask := args[0]
+		if channel, exists := s.channelMap[s.casefold(mask)]; exists {
+			if _, inChannel := channel.clientMap[client.key]; inChannel || !channel.mode.hasFlag('s') {
+				for key, member := range channel.clientMap {
+					client.sendWho(channel.name, member, channel.modeMap[key])
+				}
 			}
+		} else if target, exists := s.clientMap[s.casefold(mask)]; exists {
+			client.sendWho("*", target, nil)
 		}
+		client.reply(rplEndOfWho, mask)
 
 	case "LIST":
 		if client.registered == false {
@@ -275,14 +747,14 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 		}
 
 		if len(args) == 0 {
-			for channelName, channel := range s.channelMap {
-				if channel.mode.secret {
+			for _, channel := range s.channelMap {
+				if channel.mode.hasFlag('s') {
 					if _, inChannel := channel.clientMap[client.key]; !inChannel {
 						//Not in the channel, skip
 						continue
 					}
 				}
-				listItem := fmt.Sprintf("%s %d :%s", channelName, len(channel.clientMap), channel.topic)
+				listItem := fmt.Sprintf("%s %d :%s", channel.name, len(channel.clientMap), channel.topic)
 				client.reply(rplList, listItem)
 			}
 
@@ -291,8 +763,8 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			channels := strings.Split(args[0], ",")
 
 			for _, channelName := range channels {
-				if channel, exists := s.channelMap[strings.ToLower(channelName)]; exists {
-					listItem := fmt.Sprintf("%s %d :%s", channelName, len(channel.clientMap), channel.topic)
+				if channel, exists := s.channelMap[s.casefold(channelName)]; exists {
+					listItem := fmt.Sprintf("%s %d :%s", channel.name, len(channel.clientMap), channel.topic)
 					client.reply(rplList, listItem)
 				}
 			}
@@ -318,6 +790,7 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			if err := bcrypt.CompareHashAndPassword(hashedPassword, []byte(password)); err == nil {
 				client.operator = true
 				client.reply(rplOper)
+				s.propagate(nil, ":%s OPER", client.nick)
 				return
 			}
 		}
@@ -343,14 +816,55 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 
 		reason := strings.Join(args[1:], " ")
 
-		client, exists := s.clientMap[strings.ToLower(nick)]
+		target, exists := s.clientMap[s.casefold(nick)]
 		if !exists {
 			client.reply(errNoSuchNick, nick)
 			return
 		}
 
-		client.reply(rplKill, client.nick, reason)
-		client.disconnect()
+		if target.isService() {
+			client.reply(errNoPriv)
+			return
+		}
+
+		s.kill(target, nil, client.nick, strings.TrimPrefix(reason, ":"))
+
+	case "DIE", "RESTART":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		if client.operator == false {
+			client.reply(errNoPriv)
+			return
+		}
+
+		code := exitDie
+		if command == "RESTART" {
+			code = exitRestart
+		}
+
+		log.Printf("%s requested by %s", command, client.nick)
+
+		//Shutting down needs the event loop, so it can't block it
+		go s.terminate(code)
+
+	case "UPGRADE":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		if client.operator == false {
+			client.reply(errNoPriv)
+			return
+		}
+
+		log.Printf("UPGRADE requested by %s", client.nick)
+		client.reply(rplNotice, "Starting upgrade")
+
+		go s.upgrade()
 
 	case "KICK":
 		if client.registered == false {
@@ -363,8 +877,8 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		channelKey := strings.ToLower(args[0])
-		targetKey := strings.ToLower(args[1])
+		channelKey := s.casefold(args[0])
+		targetKey := s.casefold(args[1])
 
 		channel, channelExists := s.channelMap[channelKey]
 		if !channelExists {
@@ -378,22 +892,17 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		clientMode := channel.modeMap[client.key]
-		if !clientMode.operator && !client.operator {
-			client.reply(errNoPriv)
+		//Halfops may kick those without a rank, ops and above anyone up to
+		//their own rank
+		if !client.operator && !outranks(channel.modeMap[client.key].highest(), channel.modeMap[targetKey].highest()) {
+			client.reply(errChanOPrivsNeeded, channel.name)
 			return
 		}
 
 		reason := strings.Join(args[2:], " ")
 
 		//It worked
-		for _, client := range channel.clientMap {
-			client.reply(rplKick, client.nick, channel.name, target.nick, reason)
-		}
-
-		delete(channel.clientMap, targetKey)
-		delete(channel.modeMap, targetKey)
-		delete(target.channelMap, channelKey)
+		client.kick(channel, target, reason)
 
 	case "MODE":
 		if client.registered == false {
@@ -406,102 +915,141 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		channelKey := strings.ToLower(args[0])
+		channelKey := s.casefold(args[0])
 
 		channel, channelExists := s.channelMap[channelKey]
 		if !channelExists {
 			client.reply(errNoSuchNick, args[0])
 			return
 		}
-		mode := channel.mode
 
 		if len(args) == 1 {
 			//No more args, they just want the mode
-			client.reply(rplChannelModeIs, args[0], mode.String(), "")
+			_, inChannel := channel.clientMap[client.key]
+			client.reply(rplChannelModeIs, channel.name, channel.mode.withParams(inChannel))
+			client.reply(rplCreationTime, channel.name, strconv.FormatInt(channel.created, 10))
 			return
 		}
 
-		if cm, ok := channel.modeMap[client.key]; !ok || !cm.operator {
-			//Not a channel operator.
-
-			//If they're not an irc operator either, they'll fail
-			if !client.operator {
-				client.reply(errNoPriv)
-				return
-			}
+		if channel.modeless() {
+			client.reply(errNoChanModes, channel.name)
+			return
 		}
 
-		hasClient := false
-		var oldClientMode, newClientMode *ClientMode
-		var targetClient *Client
-		if len(args) >= 3 {
-			clientKey := strings.ToLower(args[2])
-			oldClientMode, hasClient = channel.modeMap[clientKey]
-			if hasClient {
-				targetClient = channel.clientMap[clientKey]
-				newClientMode = new(ClientMode)
-				*newClientMode = *oldClientMode
-			}
+		changes, unknown := s.parseModes(args[1:])
+		for _, char := range unknown {
+			client.reply(errUnknownMode, string(char), channel.name)
 		}
 
-		mod := strings.ToLower(args[1])
-		if strings.HasPrefix(mod, "+") {
-			for _, char := range mod {
-				switch char {
-				case 's':
-					mode.secret = true
-				case 't':
-					mode.topicLocked = true
-				case 'm':
-					mode.moderated = true
-				case 'n':
-					mode.noExternal = true
-				case 'o':
-					if hasClient {
-						newClientMode.operator = true
-					}
-				case 'v':
-					if hasClient {
-						newClientMode.voice = true
-					}
-				}
+		var allowed []modeChange
+		denied := false
+		for _, change := range changes {
+			if kind, _ := s.modeType(change.mode); kind == modeList && change.param == "" {
+				client.sendList(channel, change.mode)
+				continue
 			}
-		} else if strings.HasPrefix(mod, "-") {
-			for _, char := range mod {
-				switch char {
-				case 's':
-					mode.secret = false
-				case 't':
-					mode.topicLocked = false
-				case 'm':
-					mode.moderated = false
-				case 'n':
-					mode.noExternal = false
-				case 'o':
-					if hasClient {
-						newClientMode.operator = false
-					}
-				case 'v':
-					if hasClient {
-						newClientMode.voice = false
-					}
-				}
+
+			//IRC operators may change any mode
+			if client.operator || client.maySetMode(channel, change) {
+				allowed = append(allowed, change)
+			} else {
+				denied = true
 			}
 		}
+		if denied {
+			client.reply(errChanOPrivsNeeded, channel.name)
+		}
 
-		if hasClient {
-			*oldClientMode = *newClientMode
+		client.setChannelMode(channel, allowed)
+
+	case "CHATHISTORY":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
 		}
-		channel.mode = mode
 
-		for _, client := range channel.clientMap {
-			if hasClient {
-				client.reply(rplChannelModeIs, channel.name, args[1], targetClient.nick)
-			} else {
-				client.reply(rplChannelModeIs, channel.name, args[1], "")
-			}
+		if len(args) < 1 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		s.chatHistory(client, args)
+
+	case "LINKS":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		client.reply(rplLinks, s.name, s.name, "0")
+		for _, link := range s.linkMap {
+			client.reply(rplLinks, link.name, s.uplinkName(link), strconv.Itoa(link.hops))
+		}
+		client.reply(rplEndOfLinks)
+
+	case "CONNECT":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		if client.operator == false {
+			client.reply(errNoPriv)
+			return
+		}
+
+		if len(args) < 1 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		block, exists := s.linkBlocks[strings.ToLower(args[0])]
+		if !exists {
+			client.reply(errNoSuchServer, args[0])
+			return
+		}
+
+		if _, linked := s.linkMap[strings.ToLower(args[0])]; linked {
+			client.reply(rplNotice, fmt.Sprintf("Already linked to %s", block.name))
+			return
+		}
+
+		log.Printf("CONNECT %s requested by %s", block.name, client.nick)
+		client.reply(rplNotice, fmt.Sprintf("Connecting to %s", block.name))
+
+		//Dialing would block the event loop
+		go s.connectLink(block)
+
+	case "SQUIT":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		if client.operator == false {
+			client.reply(errNoPriv)
+			return
+		}
+
+		if len(args) < 1 {
+			client.reply(errMoreArgs)
+			return
 		}
 
+		link, exists := s.linkMap[strings.ToLower(args[0])]
+		if !exists {
+			client.reply(errNoSuchServer, args[0])
+			return
+		}
+
+		reason := strings.TrimPrefix(strings.Join(args[1:], " "), ":")
+		if reason == "" {
+			reason = "Requested by " + client.nick
+		}
+
+		log.Printf("SQUIT %s requested by %s", link.name, client.nick)
+		s.squit(link, client.nick, reason)
+
 	default:
 		client.reply(errUnknownCommand, command)
 	}
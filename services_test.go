@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+//A server linked to a test server, driven by hand with the subset of the
+//link protocol services use
+type fakeServer struct {
+	*testClient
+	name string
+}
+
+//Link a fake services server to s, waiting until it has been sent the burst
+func linkServices(t *testing.T, s *testServer) *fakeServer {
+	t.Helper()
+	return linkFake(t, s, "services.test", true)
+}
+
+//Link a fake server to s, waiting until it has been sent the burst
+func linkFake(t *testing.T, s *testServer, name string, services bool) *fakeServer {
+	t.Helper()
+
+	const password = "fakepass"
+	s.linkBlocks[name] = &linkBlock{name: name,
+		address:  "127.0.0.1:0",
+		password: password,
+		services: services}
+
+	conn, err := tls.Dial("tcp", s.tlsAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	f := &fakeServer{testClient: &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}, name: name}
+	f.send(fmt.Sprintf("SERVER %s %s", name, password))
+	f.expect("SERVER " + s.name)
+	f.expect(":" + s.name + " EOB")
+	f.send(":" + name + " EOB")
+	return f
+}
+
+//Introduce a client
+func (f *fakeServer) introduce(nick string) {
+	f.send(fmt.Sprintf(":%s UID %s %d %s 0 * :%s", f.name, nick, time.Now().Unix(), nick, nick))
+}
+
+//Services keep their nicks when they collide with a user, however old the
+//user's nick is
+func TestServicesNickCollision(t *testing.T) {
+	s := startServer(t, "a.test")
+	amy := dialClient(t, s.plainAddr, "amy")
+
+	services := linkServices(t, s)
+	services.introduce("amy")
+	if line := amy.expect(" KILL "); !strings.Contains(line, "Nick collision with services") {
+		t.Errorf("amy should have been killed for the collision, got %q", line)
+	}
+
+	//The nick now belongs to services
+	other := dialClient(t, s.plainAddr, "other")
+	other.send("NICK amy")
+	other.expect(" 433 ")
+}
+
+//Services can change a user's nick, and are told about it like any other
+//nick change
+func TestServicesForcedNickChange(t *testing.T) {
+	s := startServer(t, "a.test")
+	amy := dialClient(t, s.plainAddr, "amy")
+	dialClient(t, s.plainAddr, "bob")
+
+	services := linkServices(t, s)
+
+	//Nicks already in use can't be forced on anyone
+	services.send(":services.test SVSNICK amy bob")
+	services.send(":services.test SVSNICK amy Guest1")
+	if line := amy.expect(" NICK "); line != ":amy NICK Guest1" {
+		t.Errorf("amy should only have become Guest1, got %q", line)
+	}
+	services.expect(":amy NICK Guest1 ")
+}
+
+//Services log users in to their accounts
+func TestServicesAccount(t *testing.T) {
+	s := startServer(t, "a.test")
+	amy := dialClient(t, s.plainAddr, "amy")
+
+	services := linkServices(t, s)
+	services.send(":services.test ACCOUNT amy amyacct")
+	if line := amy.expect(" 900 "); !strings.Contains(line, "logged in as amyacct") {
+		t.Errorf("amy should be logged in as amyacct, got %q", line)
+	}
+
+	services.send(":services.test ACCOUNT amy *")
+	amy.expect(" 901 ")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+//Most messages to keep for an always-on client with nothing attached to it
+const missedLimit = 1000
+
+//Commands handled by the connection that sent them, rather than the always-on
+//client it's attached to
+func connectionCommand(command string) bool {
+	switch command {
+	case "CAP", "PING", "QUIT", "STARTTLS", "AUTHENTICATE":
+		return true
+	}
+	return false
+}
+
+//Replies that only go to the connection whose command they answer, rather
+//than to every connection attached to an always-on client
+func (code replyCode) direct() bool {
+	switch code {
+	case rplList, rplListEnd, rplInfo, rplVersion, rplPong, rplNotice, rplCap,
+		rplStartTLS, rplLinks, rplEndOfLinks, rplBatchStart, rplBatchEnd,
+		rplHistoryTarget, rplFail, rplWhoReply, rplEndOfWho, rplWhoisUser,
+		rplWhoisServer, rplWhoisOperator, rplWhoisAccount, rplWhoisChannels,
+		rplEndOfWhois, rplAway, rplInviting, rplMonList, rplEndOfMonList,
+		rplChannelModeIs, rplCreationTime, rplBanList, rplEndOfBanList,
+		rplExceptList, rplEndOfExceptList, rplInviteList, rplEndOfInviteList:
+		return true
+	}
+
+	//Errors are listed last
+	return code >= errMoreArgs
+}
+
+//Create an always-on client to take the place of a connection that's
+//registering, which is then attached to it
+func (s *Server) newSession(c *Client) *Client {
+	session := &Client{server: s,
+		address:    c.address,
+		nick:       c.nick,
+		key:        c.key,
+		nickTS:     c.nickTS,
+		username:   c.username,
+		realname:   c.realname,
+		account:    c.account,
+		channelMap: make(map[string]*Channel),
+		caps:       make(map[string]bool),
+		registered: true,
+		persistent: true}
+
+	s.addClient(session)
+	s.sessionMap[strings.ToLower(session.account)] = session
+	s.propagateLine(nil, session.uid())
+	s.monitorOnline(session)
+	return session
+}
+
+//Whether c may take over session, the always-on client of the account it's
+//logged in to
+func (c *Client) ownsSession(session *Client) bool {
+	return session.persistent && c.account != "" && strings.EqualFold(c.account, session.account)
+}
+
+//Attach a connection that just registered to an always-on client, catching
+//it up on the channels the client is in and anything it missed
+func (c *Client) attach(session *Client) {
+	c.server.removeClient(c)
+
+	c.nick = session.nick
+	c.key = session.key
+	c.registered = true
+	c.session = session
+	session.attached = append(session.attached, c)
+
+	c.reply(rplWelcome)
+	c.sendISupport()
+	for _, channel := range session.channelMap {
+		c.reply(rplJoin, c.nick, channel.name, session.accountName(), session.realname)
+		if channel.topic != "" {
+			c.sendTopic(channel)
+		}
+		c.sendNames(channel)
+	}
+
+	for i := range session.missed {
+		m := &session.missed[i]
+		c.replyTags(m.tags(), rplMsg, m.Source, m.Target, m.Text)
+	}
+	session.missed = nil
+}
+
+//Forget a connection that's gone, leaving the always-on client as it is
+func (c *Client) release(conn *Client) {
+	for i, attached := range c.attached {
+		if attached == conn {
+			c.attached = append(c.attached[:i], c.attached[i+1:]...)
+			break
+		}
+	}
+}
+
+//Send a reply to the connections attached to an always-on client, or keep
+//messages for later if there aren't any
+func (c *Client) replySession(tags map[string]string, code replyCode, args ...string) {
+	if current := c.server.current; current != nil && current.session == c {
+		if code.direct() || tags["batch"] != "" {
+			current.replyTags(tags, code, args...)
+			return
+		}
+	}
+
+	if len(c.attached) == 0 {
+		if code == rplMsg {
+			c.keepMissed(tags, args[0], args[1], args[2])
+		}
+		return
+	}
+
+	for _, conn := range c.attached {
+		conn.replyTags(tags, code, args...)
+	}
+}
+
+func (c *Client) keepMissed(tags map[string]string, source, target, text string) {
+	sent, err := time.Parse(timeFormat, tags["time"])
+	if err != nil {
+		sent = time.Now()
+	}
+
+	c.missed = append(c.missed, historyMessage{ID: tags["msgid"],
+		Time:   sent,
+		Source: source,
+		Target: target,
+		Text:   text})
+	if len(c.missed) > missedLimit {
+		c.missed = append([]historyMessage(nil), c.missed[len(c.missed)-missedLimit:]...)
+	}
+}
+
+//Show a message the client sent back to it, if it asked for that with
+//echo-message, and to any other connections attached to it
+func (c *Client) echo(tags map[string]string, code replyCode, target, message string) {
+	if !c.persistent {
+		if c.caps["echo-message"] {
+			c.replyTags(tags, code, c.nick, target, message)
+		}
+		return
+	}
+
+	for _, conn := range c.attached {
+		if conn != c.server.current || conn.caps["echo-message"] {
+			conn.replyTags(tags, code, c.nick, target, message)
+		}
+	}
+}
+
+//Whether the client has enabled a capability. An always-on client has the
+//capabilities of the connection whose command is being handled.
+func (c *Client) hasCap(name string) bool {
+	if c.persistent {
+		current := c.server.current
+		return current != nil && current.session == c && current.caps[name]
+	}
+	return c.caps[name]
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	exitOK      = 0 //Shut down cleanly after SIGTERM or SIGINT
+	exitDie     = 3 //Shut down by an operator with DIE
+	exitRestart = 4 //RESTART was requested but we couldn't exec ourselves
+)
+
+//How long to spend flushing output to clients when shutting down
+const shutdownTimeout = time.Second * 10
+
+var errServerClosed = errors.New("rosella: server closed")
+
+func (s *Server) isShuttingDown() bool {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	return s.shuttingDown
+}
+
+//Count a client thread that's about to start, unless the server is shutting
+//down. Shutdown waits on clientGroup once it has set shuttingDown, so adding
+//to it under the same lock makes sure nothing is added while it waits.
+func (s *Server) addClientThread() bool {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.clientGroup.Add(1)
+	return true
+}
+
+//Shutdown stops the server accepting new connections, sends every client the
+//shutdown notice and waits for their queued output to be written. If ctx
+//expires first, Shutdown returns its error and leaves the remaining
+//connections to be dropped when the process exits.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.listenerMutex.Lock()
+	alreadyShuttingDown := s.shuttingDown
+	s.shuttingDown = true
+	for _, l := range s.listeners {
+		l.listener.Close()
+	}
+	s.listeners = nil
+	s.listenerMutex.Unlock()
+
+	if !alreadyShuttingDown {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(shutdownTimeout)
+		}
+
+		//Only read by the event loop once it has received the event below
+		s.shutdownDeadline = deadline
+
+		done := make(chan struct{})
+		s.eventChan <- Event{event: shutdown, done: done}
+		<-done
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		s.clientGroup.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Write out everything that's kept across restarts. Called by the event loop.
+func (s *Server) persist() {
+	if err := s.saveHistory(); err != nil {
+		log.Printf("Could not save history: %s", err)
+	}
+}
+
+//Shut the server down and hand the exit code back to main
+func (s *Server) terminate(code int) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("Not all clients could be disconnected cleanly: %s", err)
+	}
+
+	s.exit(code)
+}
+
+//Hand an exit code back to main, unless one already has been
+func (s *Server) exit(code int) {
+	select {
+	case s.exitChan <- code:
+	default:
+		//Someone else already asked us to exit
+	}
+}
+
+//Replace the running process with a fresh copy of the binary
+func restart() {
+	executable, err := os.Executable()
+	if err == nil {
+		args := append([]string{os.Args[0]}, argsWithoutUpgradeFd()...)
+		err = syscall.Exec(executable, args, os.Environ())
+	}
+
+	log.Printf("Could not restart: %s", err)
+	os.Exit(exitRestart)
+}
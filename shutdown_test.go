@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Clients are told why they're being disconnected, and connections accepted
+//once shutdown has started are closed rather than served
+func TestShutdown(t *testing.T) {
+	s := startServer(t, "a.test")
+	amy := dialClient(t, s.plainAddr, "amy")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	amy.expect(s.shutdownNotice)
+
+	late, conn := net.Pipe()
+	defer late.Close()
+	s.handleConnection(conn, nil)
+
+	late.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := late.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("a connection after shutdown should be closed, got %v", err)
+	}
+}
+
+//State kept across restarts is written out when shutting down
+func TestShutdownPersists(t *testing.T) {
+	s := startServer(t, "a.test")
+	s.historyLimit = 10
+	s.historyFile = filepath.Join(t.TempDir(), "history.json")
+
+	amy := dialClient(t, s.plainAddr, "amy")
+	amy.send("JOIN #kept")
+	amy.expect(" 366 ")
+	amy.send("MODE #kept +H")
+	amy.expect("MODE #kept +H")
+	amy.send("PRIVMSG #kept :remember this")
+	amy.send("PING sync")
+	amy.expect("PONG")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(s.historyFile)
+	if err != nil || !strings.Contains(string(data), "remember this") {
+		t.Errorf("history should have been written on shutdown, got %q, %v", data, err)
+	}
+}
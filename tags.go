@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//The format of the server-time tag
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+var tagEscaper = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+var tagUnescaper = strings.NewReplacer(`\\`, `\`, `\:`, ";", `\s`, " ", `\r`, "\r", `\n`, "\n")
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
+
+//A reply held back while handling a labeled command, to be sent with its
+//label once the command is done
+type heldReply struct {
+	tags map[string]string
+	line string
+}
+
+//A unique ID for a message, shared across the network
+func newMessageID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+//The tags a new message carries wherever it goes
+func newMessageTags() map[string]string {
+	return map[string]string{"msgid": newMessageID(),
+		"time": formatTime(time.Now())}
+}
+
+//A reference for a new batch, unique to this server
+func (s *Server) newBatchID() string {
+	s.batchCount++
+	return strconv.FormatUint(s.batchCount, 36)
+}
+
+//Split the tags from the front of a line, if it has any
+func parseTags(line string) (map[string]string, string) {
+	if !strings.HasPrefix(line, "@") {
+		return nil, line
+	}
+
+	tagStr, rest := line[1:], ""
+	if i := strings.IndexByte(tagStr, ' '); i > -1 {
+		tagStr, rest = tagStr[:i], strings.TrimLeft(tagStr[i:], " ")
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(tagStr, ";") {
+		key, value, _ := strings.Cut(tag, "=")
+		if key != "" {
+			tags[key] = tagUnescaper.Replace(value)
+		}
+	}
+	return tags, rest
+}
+
+//Format tags to put in front of a line, in a stable order
+func formatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if tags[key] == "" {
+			parts = append(parts, key)
+		} else {
+			parts = append(parts, key+"="+tagEscaper.Replace(tags[key]))
+		}
+	}
+	return "@" + strings.Join(parts, ";") + " "
+}
+
+//Whether the client has enabled the capability needed to receive a tag
+func (c *Client) acceptsTag(key string) bool {
+	switch key {
+	case "time":
+		return c.caps["server-time"]
+	case "batch":
+		return c.caps["batch"]
+	case "label":
+		return c.caps["labeled-response"]
+	default:
+		return c.caps["message-tags"]
+	}
+}
+
+//Send a line to the client, with whichever of the tags it can receive
+func (c *Client) write(tags map[string]string, line string) {
+	if line == "" {
+		return
+	}
+	if c == c.server.labelClient {
+		c.server.held = append(c.server.held, heldReply{tags, line})
+		return
+	}
+
+	accepted := make(map[string]string, len(tags)+1)
+	for key, value := range tags {
+		if c.acceptsTag(key) {
+			accepted[key] = value
+		}
+	}
+	if _, ok := accepted["time"]; !ok && c.caps["server-time"] {
+		accepted["time"] = formatTime(time.Now())
+	}
+
+	c.outputChan <- formatTags(accepted) + truncateLine(line)
+}
+
+//Start a batch of replies, returning the reference to tag them with, or ""
+//if the client doesn't support batches
+func (c *Client) startBatch(batchType string, params ...string) string {
+	if !c.hasCap("batch") {
+		return ""
+	}
+
+	ref := c.server.newBatchID()
+	c.reply(rplBatchStart, ref, strings.TrimSpace(batchType+" "+strings.Join(params, " ")))
+	return ref
+}
+
+func (c *Client) endBatch(ref string) {
+	if ref != "" {
+		c.reply(rplBatchEnd, ref)
+	}
+}
+
+//Send the replies held back while handling a labeled command, as described
+//by the IRCv3 labeled-response spec
+func (s *Server) sendLabeled(c *Client, label string) {
+	held := s.held
+	s.labelClient, s.held = nil, nil
+	if c.connected == false {
+		return
+	}
+
+	labelTags := map[string]string{"label": label}
+	switch {
+	case len(held) == 0:
+		c.replyTags(labelTags, rplAck)
+	case len(held) == 1:
+		for key, value := range held[0].tags {
+			labelTags[key] = value
+		}
+		c.write(labelTags, held[0].line)
+	case c.caps["batch"]:
+		ref := s.newBatchID()
+		c.replyTags(labelTags, rplBatchStart, ref, "labeled-response")
+		for _, r := range held {
+			//Replies in batches of their own stay in them
+			if r.tags["batch"] == "" {
+				r.tags = batchTags(ref, r.tags)
+			}
+			c.write(r.tags, r.line)
+		}
+		c.reply(rplBatchEnd, ref)
+	default:
+		//Without batches there's no way to label them all
+		for _, r := range held {
+			c.write(r.tags, r.line)
+		}
+	}
+}
+
+//Tags for a reply that's part of a batch
+func batchTags(ref string, tags map[string]string) map[string]string {
+	if ref == "" {
+		return tags
+	}
+
+	batched := map[string]string{"batch": ref}
+	for key, value := range tags {
+		batched[key] = value
+	}
+	return batched
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+//What to do with lines from clients that aren't valid UTF-8, as they're
+//given to -irc-utf8
+var utf8Policies = []string{"allow", "reject", "replace"}
+
+//Longest line to send a client, not counting tags or the CRLF ending it
+const maxReplyLength = 510
+
+//Apply the server's UTF-8 policy to a line from a client, returning the line
+//to handle, or false if it's rejected
+func (s *Server) checkUTF8(line string) (string, bool) {
+	if utf8.ValidString(line) {
+		return line, true
+	}
+
+	switch s.utf8Policy {
+	case "reject":
+		return "", false
+	case "replace":
+		return strings.ToValidUTF8(line, "�"), true
+	default:
+		return line, true
+	}
+}
+
+//Whether a character is an mIRC formatting code, which are the only control
+//characters let through in text others will see
+func isFormatting(r rune) bool {
+	switch r {
+	case '\x02', '\x03', '\x04', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		return true
+	}
+	return false
+}
+
+//Remove control characters, other than formatting codes, from text
+func stripControls(text string) string {
+	return strings.Map(func(r rune) rune {
+		if (r < 0x20 || r == 0x7f) && !isFormatting(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+//Remove colours and other formatting codes from text
+func stripFormatting(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\x03':
+			//Colours are ^Cfg[,bg], each up to two digits
+			i += colourLength(text[i+1:], 2, isDigit)
+		case '\x04':
+			//Hex colours are ^Drrggbb[,rrggbb]
+			i += colourLength(text[i+1:], 6, isHexDigit)
+		case '\x02', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		default:
+			b.WriteByte(text[i])
+		}
+	}
+	return b.String()
+}
+
+//The length of the colours following a colour code, which are a foreground
+//and optional background of up to size digits each
+func colourLength(text string, size int, valid func(byte) bool) int {
+	digits := func(start int) int {
+		n := 0
+		for n < size && start+n < len(text) && valid(text[start+n]) {
+			n++
+		}
+		return n
+	}
+
+	n := digits(0)
+	if n > 0 && n < len(text) && text[n] == ',' {
+		if bg := digits(n + 1); bg > 0 {
+			n += 1 + bg
+		}
+	}
+	return n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+//Split a message into parts of at most size bytes, breaking at spaces where
+//that doesn't make parts too short, and never inside a character
+func splitMessage(message string, size int) []string {
+	size = max(size, utf8.UTFMax)
+
+	var parts []string
+	for len(message) > size {
+		cut := runeBoundary(message, size)
+
+		//A space just past the cut is as good a place to break as any
+		if space := strings.LastIndexByte(message[:cut+1], ' '); space > cut/2 {
+			parts = append(parts, message[:space])
+			message = message[space+1:]
+		} else {
+			parts = append(parts, message[:cut])
+			message = message[cut:]
+		}
+	}
+	return append(parts, message)
+}
+
+//Cut a line down to the longest that may be sent to a client, without
+//leaving part of a character at the end
+func truncateLine(line string) string {
+	if len(line) <= maxReplyLength {
+		return line
+	}
+
+	return line[:runeBoundary(line, maxReplyLength)]
+}
+
+//Where to cut text at or before n bytes so as not to split a character. Only
+//as far back as a character could start is looked at, so invalid UTF-8 is
+//cut at n rather than not at all.
+func runeBoundary(text string, n int) int {
+	cut := n
+	for cut > n-utf8.UTFMax+1 && cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if !utf8.RuneStart(text[cut]) {
+		return n
+	}
+	return cut
+}
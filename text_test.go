@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCheckUTF8(t *testing.T) {
+	tests := []struct {
+		policy string
+		line   string
+		want   string
+		ok     bool
+	}{
+		{"allow", "PRIVMSG #a :ämy", "PRIVMSG #a :ämy", true},
+		{"allow", "PRIVMSG #a :\xff", "PRIVMSG #a :\xff", true},
+		{"reject", "PRIVMSG #a :ämy", "PRIVMSG #a :ämy", true},
+		{"reject", "PRIVMSG #a :\xff", "", false},
+		{"reject", "PRIVMSG #a :\xc3", "", false},
+		{"replace", "PRIVMSG #a :ämy", "PRIVMSG #a :ämy", true},
+		{"replace", "PRIVMSG #a :\xff\xfe!", "PRIVMSG #a :�!", true},
+		{"replace", "PRIVMSG #a :a\xc3", "PRIVMSG #a :a�", true},
+	}
+
+	for _, test := range tests {
+		s := testMatchServer()
+		s.utf8Policy = test.policy
+		if got, ok := s.checkUTF8(test.line); got != test.want || ok != test.ok {
+			t.Errorf("%s %q: got %q, %t", test.policy, test.line, got, ok)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		size    int
+		parts   string
+	}{
+		{"short", 10, `["short"]`},
+		{"exactly10!", 10, `["exactly10!"]`},
+		{"hello there world", 10, `["hello ther" "e world"]`},
+		{"hello there world", 11, `["hello there" "world"]`},
+		{"hello there world", 12, `["hello there" "world"]`},
+		{"aaaaaaaaaaaaaaa", 10, `["aaaaaaaaaa" "aaaaa"]`},
+		{"a bbbbbbbbbbbbbb", 10, `["a bbbbbbbb" "bbbbbb"]`},
+		{"ääääää", 5, `["ää" "ää" "ää"]`},
+		{"a€€€", 5, `["a€" "€" "€"]`},
+		{"€€", 1, `["€" "€"]`},
+		{"\x80\x80\x80\x80\x80\x80", 4, `["\x80\x80\x80\x80" "\x80\x80"]`},
+	}
+
+	for _, test := range tests {
+		parts := splitMessage(test.message, test.size)
+		if got := fmt.Sprintf("%q", parts); got != test.parts {
+			t.Errorf("%q in %d: got %s, want %s", test.message, test.size, got, test.parts)
+		}
+	}
+}
+
+//However a message is split, its parts fit, and only spaces broken at are
+//lost. Text that isn't valid UTF-8 is still split.
+func TestSplitMessageFits(t *testing.T) {
+	messages := []string{
+		strings.Repeat("word ", 200),
+		strings.Repeat("ä€😀", 100),
+		strings.Repeat("\x80", 500),
+		strings.Repeat("a\xff\xfe", 200),
+		"😀" + strings.Repeat("\x80", 10),
+	}
+
+	for _, message := range messages {
+		for size := 1; size < 40; size++ {
+			parts := splitMessage(message, size)
+			for _, part := range parts {
+				if len(part) > max(size, utf8.UTFMax) {
+					t.Fatalf("%q in %d: part %q is too long", message[:10], size, part)
+				}
+				if utf8.ValidString(message) && !utf8.ValidString(part) {
+					t.Fatalf("%q in %d: part %q splits a character", message[:10], size, part)
+				}
+			}
+			if joined := strings.Join(parts, ""); strings.ReplaceAll(message, " ", "") != strings.ReplaceAll(joined, " ", "") {
+				t.Fatalf("%q in %d: parts %q don't make up the message", message[:10], size, parts)
+			}
+		}
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		length int
+	}{
+		{"short", 5},
+		{strings.Repeat("a", 510), 510},
+		{strings.Repeat("a", 600), 510},
+		{strings.Repeat("a", 509) + "ä", 509},
+		{strings.Repeat("a", 508) + "ä", 510},
+		{strings.Repeat("a", 507) + "😀", 507},
+		{strings.Repeat("\x80", 600), 510},
+	}
+
+	for _, test := range tests {
+		if got := truncateLine(test.line); len(got) != test.length {
+			t.Errorf("%q: got %d bytes, want %d", test.line[len(test.line)-4:], len(got), test.length)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//Only AEAD suites with forward secrecy. TLS 1.3 suites aren't configurable
+//and are all AEAD.
+var defaultCipherSuites = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+}
+
+//Build the TLS configuration shared by every listener. minVersion is "1.2" or
+//"1.3", and cipherSuites is a comma separated list of TLS 1.2 suite names, or
+//empty for the defaults.
+func newTLSConfig(minVersion, cipherSuites string) (*tls.Config, error) {
+	config := new(tls.Config)
+
+	//Linked servers may identify themselves by certificate
+	config.ClientAuth = tls.RequestClientCert
+
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported minimum TLS version %q", minVersion)
+	}
+	config.MinVersion = version
+
+	names := defaultCipherSuites
+	if cipherSuites != "" {
+		names = strings.Split(cipherSuites, ",")
+	}
+
+	for _, name := range names {
+		suite := findCipherSuite(strings.TrimSpace(name))
+		if suite == nil {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if suite.Insecure {
+			log.Printf("Warning: cipher suite %s is insecure", suite.Name)
+		}
+		config.CipherSuites = append(config.CipherSuites, suite.ID)
+	}
+
+	return config, nil
+}
+
+func findCipherSuite(name string) *tls.CipherSuite {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite
+		}
+	}
+	return nil
+}
+
+//Load each certificate and key pair given, as comma separated lists of
+//files. Clients are given the certificate matching the name they ask for
+//with SNI, and the first one otherwise. If generate is set, missing files
+//are replaced with a new self-signed certificate for hostname.
+func loadCertificates(certFiles, keyFiles, hostname string, generate bool) ([]tls.Certificate, error) {
+	certs := strings.Split(certFiles, ",")
+	keys := strings.Split(keyFiles, ",")
+	if len(certs) != len(keys) {
+		return nil, errors.New("there must be one key file for each certificate file")
+	}
+
+	var certificates []tls.Certificate
+	for i := range certs {
+		if generate && !fileExists(certs[i]) && !fileExists(keys[i]) {
+			log.Printf("Generating self-signed certificate %q for %q", certs[i], hostname)
+			if err := generateCertificate(certs[i], keys[i], hostname); err != nil {
+				return nil, err
+			}
+		}
+
+		cert, err := tls.LoadX509KeyPair(certs[i], keys[i])
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, cert)
+	}
+
+	return certificates, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+//Write out a new ECDSA key and self-signed certificate, for development
+//setups where nobody wants to run openssl
+func generateCertificate(certFile, keyFile, hostname string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{SerialNumber: serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true}
+
+	if ip := net.ParseIP(hostname); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{hostname}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	//Write the key first, so we never leave a certificate without its key
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(path, blockType string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: data}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
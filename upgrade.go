@@ -0,0 +1,689 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+//How long to wait for the new process at each step of an upgrade
+const upgradeTimeout = time.Second * 10
+
+//Max number of file descriptors to send in a single message
+const upgradeBatchSize = 200
+
+const upgradeNotice = "Server is upgrading, please reconnect"
+
+//Connections and listeners that can be handed over to a new process. TLS
+//connections can't be, as their session state only exists in this process.
+type filer interface {
+	File() (*os.File, error)
+}
+
+//Everything the new process needs to carry on where we left off. The file
+//descriptors for listeners and then clients are sent after it, in order.
+type upgradeState struct {
+	Listeners []upgradeListener
+	Clients   []upgradeClient
+	Sessions  []upgradeClient //Always-on clients, which have no file
+	Channels  []upgradeChannel
+	History   []*channelHistory
+
+	files []*os.File
+}
+
+type upgradeListener struct {
+	Network string
+	Address string
+}
+
+type upgradeClient struct {
+	Address    string
+	Nick       string
+	NickTS     int64
+	Username   string
+	Realname   string
+	Account    string
+	Registered bool
+	Operator   bool
+	Away       string
+	Monitoring []string
+	TLS        bool
+	Caps       []string         //Capabilities it has enabled
+	Invited    []string         //Channels it's been invited to
+	Listener   string           //The network and address of the listener it came in on
+	Session    string           //The account of the always-on client it's attached to
+	Missed     []historyMessage //For always-on clients
+}
+
+type upgradeChannel struct {
+	Name        string
+	Topic       string
+	TopicSetter string
+	TopicTime   int64
+	Created     int64
+	Mode        string //With the key and limit, as in SJOIN
+	Members     []upgradeMember
+	Lists       []upgradeListEntry
+}
+
+type upgradeListEntry struct {
+	Mode   string
+	Mask   string
+	Setter string
+	Time   int64
+}
+
+type upgradeMember struct {
+	Nick string
+	Mode string
+}
+
+//Hand our listeners and plaintext connections to a freshly started copy of
+//the binary, then exit. Connections that can't be handed over are sent the
+//upgrade notice and disconnected.
+func (s *Server) upgrade() {
+	//Only one upgrade may run at a time, and not while shutting down
+	s.listenerMutex.Lock()
+	busy := s.upgrading || s.shuttingDown
+	s.upgrading = true
+	s.listenerMutex.Unlock()
+	if busy {
+		log.Printf("Not upgrading, already upgrading or shutting down")
+		return
+	}
+
+	conn, cmd, err := startUpgrade()
+	if err != nil {
+		log.Printf("Could not start new process: %s", err)
+		s.cancelUpgrade()
+		return
+	}
+	defer conn.Close()
+
+	//Wait for the new process to load its configuration, so a bad binary or
+	//config file leaves us running
+	conn.SetDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		log.Printf("New process failed to start: %s", err)
+		cmd.Process.Kill()
+		cmd.Wait()
+		s.cancelUpgrade()
+		return
+	}
+
+	//From here on there's no going back, unless we started shutting down
+	//while the new process was loading
+	s.listenerMutex.Lock()
+	if s.shuttingDown {
+		s.listenerMutex.Unlock()
+		log.Printf("Not upgrading, shutting down")
+		cmd.Process.Kill()
+		cmd.Wait()
+		return
+	}
+	cmd.Process.Release()
+	s.shuttingDown = true
+	listeners := s.listeners
+	s.listeners = nil
+	s.listenerMutex.Unlock()
+
+	var listenerState []upgradeListener
+	var listenerFiles []*os.File
+	for _, l := range listeners {
+		if ul, ok := l.listener.(*net.UnixListener); ok {
+			//The new process still needs the socket file
+			ul.SetUnlinkOnClose(false)
+		}
+		if f, ok := l.listener.(filer); ok {
+			if file, err := f.File(); err == nil {
+				listenerState = append(listenerState, upgradeListener{Network: l.network, Address: l.address})
+				listenerFiles = append(listenerFiles, file)
+			}
+		}
+		l.listener.Close()
+	}
+
+	//Only read by the event loop once it has received the event below
+	s.shutdownDeadline = time.Now().Add(shutdownTimeout)
+
+	done := make(chan struct{})
+	s.eventChan <- Event{event: upgrade, done: done}
+	<-done
+
+	finished := make(chan struct{})
+	go func() {
+		s.clientGroup.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(shutdownTimeout):
+		log.Printf("Not all clients could be detached cleanly")
+	}
+
+	done = make(chan struct{})
+	s.eventChan <- Event{event: handoff, done: done}
+	<-done
+
+	state := s.handoffState
+	state.Listeners = listenerState
+	state.files = append(listenerFiles, state.files...)
+
+	log.Printf("Handing over %d listeners and %d clients", len(state.Listeners), len(state.Clients))
+
+	conn.SetDeadline(time.Now().Add(upgradeTimeout))
+	err = sendUpgradeState(conn, state)
+	if err == nil {
+		//Wait for the new process to confirm it has taken over
+		_, err = conn.Read(make([]byte, 1))
+	}
+
+	for _, file := range state.files {
+		file.Close()
+	}
+
+	if err != nil {
+		log.Printf("Upgrade failed: %s", err)
+		s.exit(exitRestart)
+		return
+	}
+
+	log.Printf("Upgrade complete.")
+	s.exit(exitOK)
+}
+
+//Allow another upgrade after one failed before handing anything over
+func (s *Server) cancelUpgrade() {
+	s.listenerMutex.Lock()
+	s.upgrading = false
+	s.listenerMutex.Unlock()
+}
+
+//Start a copy of the binary with the same arguments, passing it one end of a
+//unix socket to receive our state over
+func startUpgrade() (*net.UnixConn, *exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "upgrade")
+	remote := os.NewFile(uintptr(fds[1]), "upgrade")
+	defer local.Close()
+	defer remote.Close()
+
+	//ExtraFiles start at fd 3
+	args := append([]string{"-irc-upgrade-fd=3"}, argsWithoutUpgradeFd()...)
+
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{remote}
+
+	conn, err := net.FileConn(local)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn.(*net.UnixConn), cmd, nil
+}
+
+//Called by the event loop to disconnect every client that can't be handed
+//over and stop serving the rest
+func (s *Server) detachClients() {
+	s.stopping = true
+
+	//Clients we're keeping should see the others leave, so disconnect those
+	//first
+	for client := range s.connectionMap {
+		if _, ok := client.connection.(filer); ok || !client.connected {
+			continue
+		}
+
+		client.reply(rplNotice, upgradeNotice)
+		client.reply(rplClosingLink, upgradeNotice)
+		client.flush(s.shutdownDeadline)
+
+		if client.session == nil {
+			s.propagate(nil, ":%s QUIT :Server upgrading", client.nick)
+			client.quit("Server upgrading")
+		}
+	}
+
+	for client := range s.connectionMap {
+		if client.connected {
+			client.detach(s.shutdownDeadline)
+		}
+	}
+}
+
+//Called by the event loop once every client has been detached
+func (s *Server) snapshot() *upgradeState {
+	state := &upgradeState{}
+
+	handedOver := make(map[*Client]struct{})
+	for client := range s.connectionMap {
+		if !client.detached || client.handoffFile == nil {
+			continue
+		}
+
+		uc := upgradeClient{Address: client.address,
+			Nick:       client.nick,
+			NickTS:     client.nickTS,
+			Username:   client.username,
+			Realname:   client.realname,
+			Account:    client.account,
+			Registered: client.registered,
+			Operator:   client.operator,
+			Away:       client.away,
+			Monitoring: client.monitorNames(),
+			TLS:        client.tls,
+			Invited:    client.invitedNames()}
+		for name, enabled := range client.caps {
+			if enabled {
+				uc.Caps = append(uc.Caps, name)
+			}
+		}
+		if client.listener != nil {
+			uc.Listener = client.listener.network + " " + client.listener.address
+		}
+		if client.session != nil {
+			uc.Session = client.session.account
+		}
+
+		state.Clients = append(state.Clients, uc)
+		state.files = append(state.files, client.handoffFile)
+		handedOver[client] = struct{}{}
+	}
+
+	for _, session := range s.sessionMap {
+		state.Sessions = append(state.Sessions, upgradeClient{Address: session.address,
+			Nick:       session.nick,
+			NickTS:     session.nickTS,
+			Username:   session.username,
+			Realname:   session.realname,
+			Account:    session.account,
+			Registered: true,
+			Operator:   session.operator,
+			Away:       session.away,
+			Monitoring: session.monitorNames(),
+			Invited:    session.invitedNames(),
+			Missed:     session.missed})
+		handedOver[session] = struct{}{}
+	}
+
+	for _, history := range s.historyMap {
+		state.History = append(state.History, history)
+	}
+
+	for _, channel := range s.channelMap {
+		c := upgradeChannel{Name: channel.name,
+			Topic:       channel.topic,
+			TopicSetter: channel.topicSetter,
+			TopicTime:   channel.topicTime,
+			Created:     channel.created,
+			Mode:        channel.mode.withParams(true)}
+
+		for list, entries := range channel.lists {
+			for _, entry := range entries {
+				c.Lists = append(c.Lists, upgradeListEntry{Mode: string(list),
+					Mask:   entry.mask,
+					Setter: entry.setter,
+					Time:   entry.time})
+			}
+		}
+
+		for key, client := range channel.clientMap {
+			if _, ok := handedOver[client]; ok {
+				c.Members = append(c.Members, upgradeMember{Nick: client.nick,
+					Mode: channel.modeMap[key].String()})
+			}
+		}
+
+		if len(c.Members) > 0 {
+			state.Channels = append(state.Channels, c)
+		}
+	}
+
+	return state
+}
+
+func sendUpgradeState(conn *net.UnixConn, state *upgradeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	if _, err := conn.Write(append(header, data...)); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(state.files); i += upgradeBatchSize {
+		batch := state.files[i:]
+		if len(batch) > upgradeBatchSize {
+			batch = batch[:upgradeBatchSize]
+		}
+
+		fds := make([]int, len(batch))
+		for j, file := range batch {
+			fds[j] = int(file.Fd())
+		}
+
+		if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds...), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func receiveUpgradeState(conn *net.UnixConn) (*upgradeState, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+
+	state := new(upgradeState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+
+	expected := len(state.Listeners) + len(state.Clients)
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(upgradeBatchSize*4))
+	for len(state.files) < expected {
+		_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 {
+			return nil, errors.New("upgrade: expected file descriptors")
+		}
+
+		for _, msg := range msgs {
+			fds, err := syscall.ParseUnixRights(&msg)
+			if err != nil {
+				return nil, err
+			}
+			for _, fd := range fds {
+				state.files = append(state.files, os.NewFile(uintptr(fd), "handoff"))
+			}
+		}
+	}
+
+	return state, nil
+}
+
+//Take over from the process that started us. Must be called before the
+//server is running.
+func (s *Server) resume(fd int) (*net.UnixConn, error) {
+	file := os.NewFile(uintptr(fd), "upgrade")
+	c, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.UnixConn)
+
+	//Let the old process know we started up and are ready for its state
+	conn.SetDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := conn.Write([]byte{0}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	state, err := receiveUpgradeState(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s.inherited = make(map[string]net.Listener)
+	for i, l := range state.Listeners {
+		listener, err := net.FileListener(state.files[i])
+		state.files[i].Close()
+		if err != nil {
+			log.Printf("Could not take over listener on %s: %s", l.Address, err)
+			continue
+		}
+		s.inherited[l.Network+" "+l.Address] = listener
+	}
+
+	for _, uc := range state.Sessions {
+		session := &Client{server: s,
+			address:    uc.Address,
+			nick:       uc.Nick,
+			key:        s.casefold(uc.Nick),
+			nickTS:     uc.NickTS,
+			username:   uc.Username,
+			realname:   uc.Realname,
+			account:    uc.Account,
+			operator:   uc.Operator,
+			away:       uc.Away,
+			missed:     uc.Missed,
+			channelMap: make(map[string]*Channel),
+			caps:       make(map[string]bool),
+			registered: true,
+			persistent: true}
+		s.addClient(session)
+		s.sessionMap[strings.ToLower(session.account)] = session
+		for _, name := range uc.Monitoring {
+			session.watch(s.casefold(name), name)
+		}
+		session.invitedTo(uc.Invited)
+	}
+
+	s.resumed = make(map[string][]*Client)
+
+	var clients []*Client
+	for i, uc := range state.Clients {
+		file := state.files[len(state.Listeners)+i]
+		clientConn, err := net.FileConn(file)
+		file.Close()
+		if err != nil {
+			log.Printf("Could not take over connection for %q: %s", uc.Nick, err)
+			continue
+		}
+
+		client := s.newClient(clientConn)
+		client.address = uc.Address
+		client.nick = uc.Nick
+		client.key = s.casefold(uc.Nick)
+		client.nickTS = uc.NickTS
+		client.username = uc.Username
+		client.realname = uc.Realname
+		client.account = uc.Account
+		client.registered = uc.Registered
+		client.operator = uc.Operator
+		client.away = uc.Away
+		for _, name := range uc.Monitoring {
+			client.watch(s.casefold(name), name)
+		}
+		client.tls = uc.TLS
+		for _, name := range uc.Caps {
+			client.caps[name] = true
+		}
+		client.invitedTo(uc.Invited)
+		if uc.Listener != "" {
+			s.resumed[uc.Listener] = append(s.resumed[uc.Listener], client)
+		}
+		client.resumed = true
+
+		if session, exists := s.sessionMap[strings.ToLower(uc.Session)]; exists && uc.Session != "" {
+			client.session = session
+			session.attached = append(session.attached, client)
+		} else if client.nick != "" {
+			s.addClient(client)
+		}
+		clients = append(clients, client)
+	}
+
+	//Our own history file may be out of date
+	s.historyMap = make(map[string]*channelHistory)
+	for _, history := range state.History {
+		s.historyMap[s.casefold(history.Name)] = history
+	}
+
+	for _, uc := range state.Channels {
+		channelKey := s.casefold(uc.Name)
+		modes := strings.Fields(uc.Mode)
+		if len(modes) == 0 {
+			modes = []string{""}
+		}
+		channel := s.newChannel(uc.Name, parseChannelMode(strings.TrimPrefix(modes[0], "+"), modes[1:]))
+		channel.topic = uc.Topic
+		channel.topicSetter = uc.TopicSetter
+		channel.topicTime = uc.TopicTime
+		channel.created = uc.Created
+		for _, entry := range uc.Lists {
+			list, _ := utf8.DecodeRuneInString(entry.Mode)
+			channel.lists[list] = append(channel.lists[list], listEntry{mask: entry.Mask,
+				setter: entry.Setter,
+				time:   entry.Time})
+		}
+
+		for _, member := range uc.Members {
+			key := s.casefold(member.Nick)
+			client, exists := s.clientMap[key]
+			if !exists {
+				continue
+			}
+			channel.clientMap[key] = client
+			channel.modeMap[key] = parseClientMode(member.Mode)
+			client.channelMap[channelKey] = channel
+		}
+
+		if len(channel.clientMap) == 0 {
+			s.removeChannel(channel)
+		}
+	}
+
+	for _, client := range clients {
+		if s.addClientThread() {
+			go client.clientThread()
+		}
+	}
+
+	log.Printf("Took over %d listeners and %d clients", len(s.inherited), len(clients))
+
+	return conn, nil
+}
+
+//Tell the old process we've taken over, once our listeners are being served
+func (s *Server) finishResume(conn *net.UnixConn) {
+	conn.Write([]byte{0})
+	conn.Close()
+
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+
+	for name, listener := range s.inherited {
+		log.Printf("Listener %q is no longer configured, closing it", name)
+		listener.Close()
+	}
+	s.inherited = nil
+	s.resumed = nil
+}
+
+//The channels a client has been invited to, to be handed over
+func (c *Client) invitedNames() []string {
+	names := make([]string, 0, len(c.invited))
+	for name := range c.invited {
+		names = append(names, name)
+	}
+	return names
+}
+
+//Restore the channels a client had been invited to before an upgrade
+func (c *Client) invitedTo(names []string) {
+	for _, name := range names {
+		if c.invited == nil {
+			c.invited = make(map[string]struct{})
+		}
+		c.invited[c.server.casefold(name)] = struct{}{}
+	}
+}
+
+//Parse channel modes as they're given in SJOIN, with the key and limit in
+//params if they're set
+func parseChannelMode(modes string, params []string) ChannelMode {
+	var mode ChannelMode
+	for _, char := range modes {
+		switch char {
+		case 'k', 'l':
+			if len(params) == 0 {
+				continue
+			}
+			if char == 'k' {
+				mode.key = params[0]
+			} else {
+				mode.limit, _ = strconv.Atoi(params[0])
+			}
+			params = params[1:]
+		default:
+			mode.setFlag(char, true)
+		}
+	}
+	return mode
+}
+
+func parseClientMode(modes string) *ClientMode {
+	mode := new(ClientMode)
+	for _, r := range ranks {
+		if strings.ContainsRune(modes, r.mode) {
+			mode.set(r.rank, true)
+		}
+	}
+	return mode
+}
+
+//The arguments we were started with, without -irc-upgrade-fd. Only the
+//process an upgrade starts should ever resume from one.
+func argsWithoutUpgradeFd() []string {
+	var args []string
+	for i := 1; i < len(os.Args); i++ {
+		name := strings.TrimLeft(os.Args[i], "-")
+		if name == "irc-upgrade-fd" {
+			//The value is the next argument
+			i++
+			continue
+		}
+		if !strings.HasPrefix(name, "irc-upgrade-fd=") {
+			args = append(args, os.Args[i])
+		}
+	}
+	return args
+}
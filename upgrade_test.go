@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+//Hand a's clients over to a new server in this process, the way an upgrade
+//hands them to a new process
+func handOver(t *testing.T, a *testServer) *Server {
+	t.Helper()
+
+	done := make(chan struct{})
+	a.eventChan <- Event{event: upgrade, done: done}
+	<-done
+	a.clientGroup.Wait()
+
+	done = make(chan struct{})
+	a.eventChan <- Event{event: handoff, done: done}
+	<-done
+	state := a.handoffState
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := os.NewFile(uintptr(fds[0]), "upgrade")
+	old, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { old.Close() })
+
+	go func() {
+		if _, err := old.Read(make([]byte, 1)); err == nil {
+			sendUpgradeState(old.(*net.UnixConn), state)
+		}
+		for _, file := range state.files {
+			file.Close()
+		}
+	}()
+
+	b := NewServer()
+	b.name = a.name
+	conn, err := b.resume(fds[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Run()
+	b.finishResume(conn)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		b.Shutdown(ctx)
+	})
+	return b
+}
+
+//Clients handed over keep the capabilities they enabled and the invites
+//they were sent
+func TestUpgradeKeepsClientState(t *testing.T) {
+	a := startServer(t, "a.test")
+
+	amy := dialClient(t, a.plainAddr, "amy")
+	amy.send("CAP REQ :echo-message message-tags")
+	amy.expect(" ACK ")
+
+	bob := dialClient(t, a.plainAddr, "bob")
+	bob.send("JOIN #invite")
+	bob.expect(" 366 ")
+	bob.send("MODE #invite +i")
+	bob.expect("MODE #invite +i")
+	bob.send("INVITE amy #invite")
+	amy.expect("INVITE amy #invite")
+
+	handOver(t, a)
+
+	amy.send("CAP LIST")
+	if line := amy.expect(" LIST "); !strings.Contains(line, "echo-message") || !strings.Contains(line, "message-tags") {
+		t.Errorf("amy should have kept their capabilities, got %q", line)
+	}
+
+	amy.send("JOIN #invite")
+	amy.expect(":amy JOIN #invite")
+}
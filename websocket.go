@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//From RFC 6455, used to compute Sec-WebSocket-Accept
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+//Largest message we'll accept from a client, which is a generous allowance
+//for a line with tags
+const websocketMaxMessage = 8192
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+var errWebsocketProtocol = errors.New("websocket: protocol error")
+
+//Serve a websocket listener, handing each upgraded connection to the server
+func (s *Server) serveWebSocket(l *Listener, listener net.Listener) error {
+	if l.tlsConfig != nil {
+		listener = tls.NewListener(listener, l.tlsConfig)
+	}
+
+	server := &http.Server{Handler: &websocketHandler{server: s, listener: l},
+		ConnContext:       websocketConnContext,
+		ReadHeaderTimeout: time.Second * 30}
+
+	err := server.Serve(listener)
+	if s.isShuttingDown() {
+		return errServerClosed
+	}
+	return err
+}
+
+type websocketHandler struct {
+	server   *Server
+	listener *Listener
+}
+
+func (h *websocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.listener.loopbackOnly {
+		addr, ok := r.Context().Value(peerAddrKey{}).(*net.TCPAddr)
+		if !ok || !addr.IP.IsLoopback() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	if r.Method != "GET" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "This is an IRC websocket gateway", http.StatusUpgradeRequired)
+		return
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported websocket version", http.StatusBadRequest)
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+
+	if !h.listener.allowsOrigin(r.Header.Get("Origin")) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	//Use the first IRCv3 subprotocol the client offers, or text without one
+	protocol := ""
+	for _, offered := range headerValues(r.Header, "Sec-WebSocket-Protocol") {
+		if offered == "binary.ircv3.net" || offered == "text.ircv3.net" {
+			protocol = offered
+			break
+		}
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Websockets not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Could not hijack websocket connection: %s", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n"
+	if protocol != "" {
+		response += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	response += "\r\n"
+
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return
+	}
+
+	ws := newWebsocketConn(conn, rw.Reader, protocol == "binary.ircv3.net")
+	h.server.handleConnection(ws, h.listener)
+}
+
+//Whether a browser page from origin may connect
+func (l *Listener) allowsOrigin(origin string) bool {
+	if len(l.origins) == 0 {
+		return true
+	}
+	for _, allowed := range l.origins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+//Whether any comma separated value of the header matches value
+func headerContains(header http.Header, name, value string) bool {
+	for _, v := range headerValues(header, name) {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func headerValues(header http.Header, name string) []string {
+	var values []string
+	for _, line := range header[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+//A websocket connection which looks like a plain IRC connection to the rest
+//of the server. Each websocket message carries a single line, without the
+//line ending.
+type websocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+	binary bool //binary.ircv3.net rather than text.ircv3.net
+
+	//Messages are decoded by their own goroutine, so that read timeouts
+	//can't interrupt a frame half way through. It closes incoming when the
+	//connection ends.
+	incoming chan []byte
+	pending  []byte
+
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+
+	writeMutex sync.Mutex
+	closeSent  bool //nothing may be sent after a close frame
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+type websocketTimeout struct{}
+
+func (websocketTimeout) Error() string   { return "websocket: read timeout" }
+func (websocketTimeout) Timeout() bool   { return true }
+func (websocketTimeout) Temporary() bool { return true }
+
+func newWebsocketConn(conn net.Conn, reader *bufio.Reader, binary bool) *websocketConn {
+	ws := &websocketConn{Conn: conn,
+		reader:   reader,
+		binary:   binary,
+		incoming: make(chan []byte, 16),
+		closed:   make(chan struct{})}
+
+	go ws.readMessages()
+	return ws
+}
+
+func (ws *websocketConn) readMessages() {
+	defer close(ws.incoming)
+
+	var message []byte
+	fragmented := false
+	for {
+		final, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+
+		//Control frames can come between the fragments of a message, but
+		//can't be fragmented themselves
+		if opcode >= opClose && (!final || len(payload) > 125) {
+			return
+		}
+		//Continuations must follow the start of a message, and a new message
+		//can't start until the last has finished
+		if (opcode == opContinuation) != fragmented && opcode < opClose {
+			return
+		}
+
+		switch opcode {
+		case opText, opBinary, opContinuation:
+			fragmented = !final
+			message = append(message, payload...)
+			if len(message) > websocketMaxMessage {
+				ws.writeFrame(opClose, []byte{0x03, 0xf1}) //1009, message too big
+				return
+			}
+			if final {
+				select {
+				case ws.incoming <- append(message, '\r', '\n'):
+				case <-ws.closed:
+					return
+				}
+				message = nil
+			}
+		case opPing:
+			ws.writeFrame(opPong, payload)
+		case opPong:
+		case opClose:
+			ws.writeFrame(opClose, nil)
+			return
+		default:
+			return
+		}
+	}
+}
+
+func (ws *websocketConn) readFrame() (final bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(ws.reader, header); err != nil {
+		return
+	}
+
+	final = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	//Clients must always mask their frames
+	if !masked {
+		err = errWebsocketProtocol
+		return
+	}
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(ws.reader, ext); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(ws.reader, ext); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if length > websocketMaxMessage {
+		err = errWebsocketProtocol
+		return
+	}
+
+	mask := make([]byte, 4)
+	if _, err = io.ReadFull(ws.reader, mask); err != nil {
+		return
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+
+	if ws.closeSent {
+		return net.ErrClosed
+	}
+	ws.closeSent = opcode == opClose
+
+	_, err := ws.Conn.Write(append(header, payload...))
+	return err
+}
+
+func (ws *websocketConn) Read(p []byte) (int, error) {
+	if len(ws.pending) == 0 {
+		ws.deadlineMutex.Lock()
+		deadline := ws.readDeadline
+		ws.deadlineMutex.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case message, ok := <-ws.incoming:
+			if !ok {
+				return 0, io.EOF
+			}
+			ws.pending = message
+		case <-timeout:
+			return 0, websocketTimeout{}
+		}
+	}
+
+	n := copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+//Send each line written as its own message
+func (ws *websocketConn) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(string(p), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		opcode := byte(opBinary)
+		if !ws.binary {
+			opcode = opText
+			line = strings.ToValidUTF8(line, "�")
+		}
+
+		if err := ws.writeFrame(opcode, []byte(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (ws *websocketConn) Close() error {
+	err := net.ErrClosed
+	ws.closeOnce.Do(func() {
+		close(ws.closed)
+		ws.writeFrame(opClose, []byte{0x03, 0xe9}) //1001, going away
+		err = ws.Conn.Close()
+	})
+	return err
+}
+
+func (ws *websocketConn) SetDeadline(t time.Time) error {
+	ws.SetReadDeadline(t)
+	return ws.Conn.SetWriteDeadline(t)
+}
+
+func (ws *websocketConn) SetReadDeadline(t time.Time) error {
+	ws.deadlineMutex.Lock()
+	ws.readDeadline = t
+	ws.deadlineMutex.Unlock()
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//A frame as a client sends it, masked unless told otherwise
+func clientFrame(final bool, opcode byte, payload string, masked bool) []byte {
+	frame := []byte{opcode, 0}
+	if final {
+		frame[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	frame[1] |= 0x80
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+//Split the frames the server sent into "opcode:payload" strings
+func serverFrames(data []byte) []string {
+	var frames []string
+	for len(data) >= 2 {
+		length, start := int(data[1]&0x7f), 2
+		switch length {
+		case 126:
+			length, start = int(binary.BigEndian.Uint16(data[2:])), 4
+		case 127:
+			length, start = int(binary.BigEndian.Uint64(data[2:])), 10
+		}
+		frames = append(frames, fmt.Sprintf("%x:%s", data[0]&0x0f, data[start:start+length]))
+		data = data[start+length:]
+	}
+	return frames
+}
+
+//Send frames to a websocket connection, returning the lines it read from them
+//until the connection ended, and the frames it sent back
+func websocketExchange(t *testing.T, frames ...[]byte) (string, []string) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	ws := newWebsocketConn(server, bufio.NewReader(server), false)
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+
+	replies := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(client)
+		replies <- data
+	}()
+	go func() {
+		for _, frame := range frames {
+			if _, err := client.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	lines, err := io.ReadAll(ws)
+	if err != nil {
+		t.Errorf("the connection should have ended, got %v", err)
+	}
+	ws.Close()
+	return string(lines), serverFrames(<-replies)
+}
+
+func TestWebsocketFraming(t *testing.T) {
+	closeFrame := clientFrame(true, opClose, "", true)
+	long := "PRIVMSG #test :" + strings.Repeat("a", 300)
+
+	tests := []struct {
+		comment string
+		frames  [][]byte
+		lines   string
+		replies []string
+	}{
+		{"text",
+			[][]byte{clientFrame(true, opText, "PING a", true), closeFrame},
+			"PING a\r\n", []string{"8:"}},
+		{"binary",
+			[][]byte{clientFrame(true, opBinary, "PING \xff", true), closeFrame},
+			"PING \xff\r\n", []string{"8:"}},
+		{"16 bit length",
+			[][]byte{clientFrame(true, opText, long, true), closeFrame},
+			long + "\r\n", []string{"8:"}},
+		{"fragmented",
+			[][]byte{clientFrame(false, opText, "PING", true),
+				clientFrame(false, opContinuation, " a", true),
+				clientFrame(true, opContinuation, "b", true), closeFrame},
+			"PING ab\r\n", []string{"8:"}},
+		{"ping between fragments",
+			[][]byte{clientFrame(false, opText, "PING", true),
+				clientFrame(true, opPing, "hello", true),
+				clientFrame(true, opContinuation, " a", true), closeFrame},
+			"PING a\r\n", []string{"a:hello", "8:"}},
+		{"unmasked",
+			[][]byte{clientFrame(true, opText, "PING a", false)},
+			"", []string{"8:\x03\xe9"}},
+		{"frame too long",
+			[][]byte{clientFrame(true, opText, strings.Repeat("a", websocketMaxMessage+1), true)},
+			"", []string{"8:\x03\xe9"}},
+		{"message too long",
+			[][]byte{clientFrame(false, opText, strings.Repeat("a", websocketMaxMessage), true),
+				clientFrame(true, opContinuation, "a", true)},
+			"", []string{"8:\x03\xf1"}},
+		{"continuation without a start",
+			[][]byte{clientFrame(true, opContinuation, "PING a", true)},
+			"", []string{"8:\x03\xe9"}},
+		{"message during a message",
+			[][]byte{clientFrame(false, opText, "PING", true),
+				clientFrame(true, opText, "PING a", true)},
+			"", []string{"8:\x03\xe9"}},
+		{"fragmented ping",
+			[][]byte{clientFrame(false, opPing, "hello", true)},
+			"", []string{"8:\x03\xe9"}},
+		{"ping too long",
+			[][]byte{clientFrame(true, opPing, strings.Repeat("a", 126), true)},
+			"", []string{"8:\x03\xe9"}},
+		{"unknown opcode",
+			[][]byte{clientFrame(true, 0x3, "PING a", true)},
+			"", []string{"8:\x03\xe9"}},
+	}
+
+	for _, test := range tests {
+		lines, replies := websocketExchange(t, test.frames...)
+		if lines != test.lines {
+			t.Errorf("%s: read %q, want %q", test.comment, lines, test.lines)
+		}
+		if fmt.Sprint(replies) != fmt.Sprint(test.replies) {
+			t.Errorf("%s: sent %q, want %q", test.comment, replies, test.replies)
+		}
+	}
+}
+
+//Each line written goes in a message of its own, as text unless the client
+//asked for binary
+func TestWebsocketWrite(t *testing.T) {
+	tests := []struct {
+		binary  bool
+		written string
+		frames  []string
+	}{
+		{false, "PING a\r\n", []string{"1:PING a"}},
+		{false, "PING a\r\nPING b\r\n", []string{"1:PING a", "1:PING b"}},
+		{false, "PING a\n\r\nPING b", []string{"1:PING a", "1:PING b"}},
+		{false, "PING \xff\r\n", []string{"1:PING �"}},
+		{true, "PING \xff\r\n", []string{"2:PING \xff"}},
+	}
+
+	for _, test := range tests {
+		client, server := net.Pipe()
+		ws := newWebsocketConn(server, bufio.NewReader(server), test.binary)
+
+		sent := make(chan []byte)
+		go func() {
+			data, _ := io.ReadAll(client)
+			sent <- data
+		}()
+		ws.Write([]byte(test.written))
+		ws.Close()
+
+		frames := serverFrames(<-sent)
+		frames = frames[:len(frames)-1] //the close frame
+		if fmt.Sprint(frames) != fmt.Sprint(test.frames) {
+			t.Errorf("%q: sent %q, want %q", test.written, frames, test.frames)
+		}
+	}
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	l := &Listener{origins: []string{"https://chat.example.com", "https://example.com"}}
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://chat.example.com", true},
+		{"https://example.com", true},
+		{"HTTPS://Chat.Example.com", true},
+		{"http://chat.example.com", false},
+		{"https://chat.example.com.evil.test", false},
+		{"https://evil.test", false},
+		{"null", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if l.allowsOrigin(test.origin) != test.allowed {
+			t.Errorf("%q: allowed should be %v", test.origin, test.allowed)
+		}
+	}
+
+	anywhere := &Listener{}
+	for _, test := range tests {
+		if !anywhere.allowsOrigin(test.origin) {
+			t.Errorf("%q should be allowed without any origins given", test.origin)
+		}
+	}
+}
+
+func TestWebsocketHandshake(t *testing.T) {
+	s := startServer(t, "a.test")
+	l, err := s.Listen("ws://127.0.0.1:0?origin=https://chat.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	tests := []struct {
+		comment  string
+		headers  string
+		status   int
+		protocol string
+	}{
+		{"no subprotocol", "Origin: https://chat.example.com\r\n", 101, ""},
+		{"text", "Origin: https://chat.example.com\r\nSec-WebSocket-Protocol: text.ircv3.net\r\n", 101, "text.ircv3.net"},
+		{"first known subprotocol", "Origin: https://chat.example.com\r\nSec-WebSocket-Protocol: chat, binary.ircv3.net, text.ircv3.net\r\n", 101, "binary.ircv3.net"},
+		{"other origin", "Origin: https://evil.test\r\n", 403, ""},
+		{"no origin", "", 403, ""},
+	}
+
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", l.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(testTimeout))
+
+		//The sample key from RFC 6455
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n"+
+			"Connection: Upgrade\r\nUpgrade: websocket\r\n"+
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+			"%s\r\n", test.headers)
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%s: %s", test.comment, err)
+		}
+
+		if response.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.comment, response.StatusCode, test.status)
+			continue
+		}
+		if test.status != 101 {
+			continue
+		}
+		if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Errorf("%s: got Sec-WebSocket-Accept %q", test.comment, accept)
+		}
+		if protocol := response.Header.Get("Sec-WebSocket-Protocol"); protocol != test.protocol {
+			t.Errorf("%s: got subprotocol %q, want %q", test.comment, protocol, test.protocol)
+		}
+	}
+}